@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"ogomon/internal/ebpf"
+	"ogomon/pkg"
+
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+var (
+	cleanupDevice string
+	cleanupNetNS  string
+)
+
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Remove tc filters and XDP programs a crashed ogomon left on a device",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		removed := 0
+		cleanup := func() error {
+			var err error
+			removed, err = ebpf.CleanupDevice(cleanupDevice)
+			return err
+		}
+		var err error
+		if cleanupNetNS == "" {
+			err = cleanup()
+		} else {
+			err = pkg.RunInNetNS(cleanupNetNS, cleanup)
+		}
+		jww.INFO.Printf("Removed %d ogomon programs from %s", removed, cleanupDevice)
+		return err
+	},
+}
+
+func init() {
+	cleanupCmd.Flags().StringVarP(&cleanupDevice, "device", "d", "", "Interface to clean up")
+	cleanupCmd.Flags().StringVar(&cleanupNetNS, "net-ns", "", "Network namespace of the interface, e.g. /proc/<pid>/ns/net")
+	cleanupCmd.MarkFlagRequired("device")
+	rootCmd.AddCommand(cleanupCmd)
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"ogomon/internal"
 	"ogomon/internal/ebpf"
@@ -9,10 +10,10 @@ import (
 	"os/exec"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
-	"errors"
 
 	"github.com/prometheus/procfs"
 	"github.com/spf13/cobra"
@@ -23,14 +24,33 @@ type Monitor struct {
 	fs procfs.FS
 	proc procfs.Proc
 	cancelChan chan bool
+	netNSPath string
 }
 
 var (
 	deviceName	   string
 	srcPort    	   int
 	destPort   	   int
+	packetFilterExpr   string
+	packetFilterFile   string
+	netBackend	   string
+	packetDirection	   string
+	packetEvents	   bool
+	packetAttribution  string
 	executableName	   string
 	pid		   int
+	containerID	   string
+	wholeContainer	   bool
+	pidNamespace	   string
+	session		   *internal.Session
+	waitForTarget	   bool
+	waitTimeout	   time.Duration
+	smapsInterval	   time.Duration
+	fdLeakWindow	   time.Duration
+	blockDevices	   []string
+	currentProc	   procfs.Proc
+	currentPacketTracer packetTracer
+	packetTracerMu	   sync.Mutex
 	wg		   sync.WaitGroup
 	controlWg	   sync.WaitGroup
 )
@@ -40,28 +60,66 @@ func (m Monitor) Start(appendFile bool) error {
 	jww.INFO.Printf("PID: %d", stat.PID)
 	jww.INFO.Printf("Executable Name: %s", stat.Comm)
 
-	packetCaptureTracer, err := ebpf.NewPacketCaptureTracer(deviceName, appendFile)
-	// socketTracer, err := ebpf.NewFilterSocketTracer(deviceName, srcPort, destPort, appendFile)
+	packetTracer, err := m.newPacketTracer(appendFile)
 	if err != nil {
 		jww.ERROR.Fatalln(err)
 	}
-	diskReadTracer, err := internal.NewDiskReadTracer(&m.proc, appendFile)
-	diskWriteTracer, err := internal.NewDiskWriteTracer(&m.proc, appendFile)
-	memoryTracer, err := internal.NewMemoryTracer(&m.proc, appendFile)
-	residentMemoryTracer, err := internal.NewResidentMemoryTracer(&m.proc, appendFile)
-	dataVirtualMemoryTracer, err := internal.NewDataVirtualMemoryTracer(&m.proc, appendFile)
-	CSTimeTrace, err := internal.NewCSTimeTracer(&m.proc, appendFile)
-	CUTimeTrace, err := internal.NewCUTimeTracer(&m.proc, appendFile)
-	STimeTracer, err := internal.NewSTimeTracer(&m.proc, appendFile)
-	UTimeTracer, err := internal.NewUTimeTracer(&m.proc, appendFile)
-	TCPTXTracer, err := internal.NewNetTCPTracer(&m.fs, appendFile)
-	TCP6TXTracer, err := internal.NewNetTCPV6Tracer(&m.fs, appendFile)
-	MemAvaibleTracer, err := internal.NewMemAvaibaleTracer(&m.fs, appendFile)
-	
-
-	tracers := []internal.Tracer{diskWriteTracer, diskReadTracer, residentMemoryTracer, memoryTracer, dataVirtualMemoryTracer, CSTimeTrace, CUTimeTrace, STimeTracer, UTimeTracer, TCPTXTracer, TCP6TXTracer, MemAvaibleTracer}
+	var tracers []internal.Tracer
+	// addTracer keeps the tracers that could be created, one missing source
+	// does not stop the others from recording.
+	addTracer := func(tracer internal.Tracer, err error) {
+		if err != nil {
+			jww.ERROR.Println("Not recording: ", err)
+			return
+		}
+		tracers = append(tracers, tracer)
+	}
+	addTracer(internal.NewIOTracer(&m.proc, appendFile))
+	addTracer(internal.NewDiskStatsTracer(&m.proc, blockDevices, appendFile))
+	addTracer(internal.NewMemoryTracer(&m.proc, appendFile))
+	addTracer(internal.NewResidentMemoryTracer(&m.proc, appendFile))
+	addTracer(internal.NewDataVirtualMemoryTracer(&m.proc, appendFile))
+	addTracer(internal.NewCSTimeTracer(&m.proc, appendFile))
+	addTracer(internal.NewCUTimeTracer(&m.proc, appendFile))
+	addTracer(internal.NewSTimeTracer(&m.proc, appendFile))
+	addTracer(internal.NewUTimeTracer(&m.proc, appendFile))
+	addTracer(internal.NewMinorFaultTracer(&m.proc, appendFile))
+	addTracer(internal.NewMajorFaultTracer(&m.proc, appendFile))
+	addTracer(internal.NewCMinorFaultTracer(&m.proc, appendFile))
+	addTracer(internal.NewCMajorFaultTracer(&m.proc, appendFile))
+	addTracer(internal.NewNetTCPTracer(&m.fs, appendFile))
+	addTracer(internal.NewNetTCPV6Tracer(&m.fs, appendFile))
+	addTracer(internal.NewProcTCPQueueTracer(&m.proc, appendFile))
+	addTracer(internal.NewProcTCPConnectionTracer(&m.proc, appendFile))
+	addTracer(internal.NewNetProtoTracer(&m.proc, appendFile))
+	addTracer(internal.NewMemAvaibaleTracer(&m.fs, appendFile))
+	addTracer(internal.NewPressureTracer(&m.fs, appendFile))
+	addTracer(internal.NewCPUTracer(&m.fs, &m.proc, appendFile))
+	addTracer(internal.NewSoftirqTracer(&m.proc, appendFile))
+	addTracer(internal.NewContextSwitchTracer(&m.proc, appendFile))
+	addTracer(internal.NewSchedDelayTracer(&m.proc, appendFile))
+	addTracer(internal.NewSmapsRollupTracer(&m.proc, smapsInterval, appendFile))
+	addTracer(internal.NewFileDescriptorTracer(&m.proc, session, fdLeakWindow, appendFile))
+	if wholeContainer {
+		addTracer(internal.NewContainerTracer(&m.proc, procfs.DefaultMountPoint, containerID, appendFile))
+	}
+	if netDevTracer, err := internal.NewNetDevTracer(&m.proc, deviceName, appendFile); err == nil {
+		tracers = append(tracers, netDevTracer)
+	} else {
+		jww.INFO.Println("Not recording interface counters: ", err)
+	}
+	if cgroupPressureTracer, err := internal.NewCgroupPressureTracer(&m.proc, appendFile); err == nil {
+		tracers = append(tracers, cgroupPressureTracer)
+	} else {
+		jww.INFO.Println("Not recording cgroup pressure: ", err)
+	}
 
-	go packetCaptureTracer.Start()
+	if packetTracer != nil {
+		packetTracerMu.Lock()
+		currentPacketTracer = packetTracer
+		packetTracerMu.Unlock()
+		go packetTracer.Start()
+	}
 
 	for idx, _ := range tracers {
 		wg.Add(1)
@@ -72,8 +130,8 @@ func (m Monitor) Start(appendFile bool) error {
 	}
 
 	// external commands section
-	cpuMemCommand := exec.Command("sudo", "./python/cpu_mem.py", "-p", fmt.Sprintf("%d", stat.PID), "-s", strconv.FormatInt(memoryTracer.GetTickerTime().Nanoseconds(), 10))
-	cudaMemCommand := exec.Command("sudo", "./python/cuda_mem.py", "-p", fmt.Sprintf("%d", stat.PID), "-s", strconv.FormatInt(memoryTracer.GetTickerTime().Nanoseconds(), 10))
+	cpuMemCommand := exec.Command("sudo", "./python/cpu_mem.py", "-p", fmt.Sprintf("%d", stat.PID), "-s", strconv.FormatInt(internal.SYS_STAT_TICKER_TIME.Nanoseconds(), 10))
+	cudaMemCommand := exec.Command("sudo", "./python/cuda_mem.py", "-p", fmt.Sprintf("%d", stat.PID), "-s", strconv.FormatInt(internal.SYS_STAT_TICKER_TIME.Nanoseconds(), 10))
 	sendMsgCommand := exec.Command("sudo", "./python/sendmsg.py", "-p", fmt.Sprintf("%d", stat.PID))
 	sendToCommand := exec.Command("sudo", "./python/sendto.py", "-p", fmt.Sprintf("%d", stat.PID))
 	kcacheCommand := exec.Command("sudo", "./python/kcache.py", "-p", fmt.Sprintf("%d", stat.PID))
@@ -88,10 +146,6 @@ func (m Monitor) Start(appendFile bool) error {
 	go pkg.CreateProcessAndPipeToFile(tcpSendMsgCommand, "./records/tcpsendmsg", appendFile)
 	// external commands section
 
-	if err != nil {
-		panic(err)
-	}
-
 	<-m.cancelChan
 	
 	cpuMemCommand.Process.Kill()
@@ -106,77 +160,293 @@ func (m Monitor) Start(appendFile bool) error {
 		t.Stop()
 	}
 
-	packetCaptureTracer.TearDown()
-	jww.INFO.Println("TEAR DOWN CALLED FOR PACKET TRACE")
+	if packetTracer != nil {
+		packetTracerMu.Lock()
+		currentPacketTracer = nil
+		packetTracerMu.Unlock()
+		packetTracer.TearDown()
+		jww.INFO.Println("TEAR DOWN CALLED FOR PACKET TRACE")
+	}
 
 	wg.Wait()
 	controlWg.Done()
 	return nil
 }
 
+// packetTracer is a network capture backend, Start blocks until TearDown.
+type packetTracer interface {
+	Start()
+	TearDown()
+}
+
+// filterSetter is a packet tracer whose filter can change while it runs.
+type filterSetter interface {
+	SetFilter(filter ebpf.Filter) error
+}
+
+// newPacketTracer creates the --net-backend tracer, or nil for none. It runs in
+// the target's network namespace when monitoring a container, so deviceName
+// refers to the container's interface.
+func (m Monitor) newPacketTracer(appendFile bool) (packetTracer, error) {
+	if netBackend == "none" {
+		return nil, nil
+	}
+	directions, err := packetDirections()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := packetFilter()
+	if err != nil {
+		return nil, err
+	}
+	if netBackend == "socket" && len(directions) == 1 {
+		filter.AddDirection(directions[0])
+	}
+	if filter.Attribution, err = ebpf.NewAttribution(packetAttribution, m.proc); err != nil {
+		return nil, err
+	}
+	var tracer packetTracer
+	newTracer := func() error {
+		var err error
+		switch netBackend {
+		case "pfring":
+			if len(packetFilterExpr) > 0 || packetFilterFile != "" {
+				jww.INFO.Println("The pfring backend does not apply --filter")
+			}
+			tracer, err = ebpf.NewPacketCaptureTracer(deviceName, directions, appendFile)
+		case "socket":
+			tracer, err = ebpf.NewFilterSocketTracer(deviceName, filter, packetEvents, appendFile)
+		case "tc":
+			tracer, err = ebpf.NewTcNetworkTracer(deviceName, filter, directions, packetEvents, appendFile)
+		case "xdp":
+			if len(directions) != 1 {
+				jww.INFO.Println("The xdp backend only captures ingress packets")
+			}
+			tracer, err = ebpf.NewXdpNetworkTracer(deviceName, filter, packetEvents, appendFile)
+		default:
+			err = fmt.Errorf("unknown network backend %q", netBackend)
+		}
+		return err
+	}
+	if m.netNSPath == "" {
+		err = newTracer()
+	} else {
+		err = pkg.RunInNetNS(m.netNSPath, newTracer)
+	}
+	return tracer, err
+}
+
+func packetDirections() ([]ebpf.Direction, error) {
+	switch packetDirection {
+	case "ingress":
+		return []ebpf.Direction{ebpf.INGRESS}, nil
+	case "egress":
+		return []ebpf.Direction{ebpf.EGRESS}, nil
+	case "both":
+		return []ebpf.Direction{ebpf.INGRESS, ebpf.EGRESS}, nil
+	}
+	return nil, fmt.Errorf("unknown direction %q", packetDirection)
+}
+
 func monitorProcess(proc procfs.Proc, fs procfs.FS, cancelChan chan bool, appendFile bool) error {
 	m := Monitor{proc: proc, fs: fs, cancelChan: cancelChan}
+	if containerID != "" {
+		m.netNSPath = pkg.NetNSPath(procfs.DefaultMountPoint, proc.PID)
+	}
 	if err := m.Start(appendFile); err != nil {
 		return err
 	}
 	return nil
 }
 
-func newOgomon(exeName string, pid int, notFoundChan chan bool, cancelChan chan bool, appendFile bool) {
-	proc, err := pkg.GetTargetProc(exeName, pid)
-	fs, err := procfs.NewDefaultFS()
-	found := false
+// packetFilter combines --filter, the terms of --filter-file and the
+// --src-port and --dest-port shorthands.
+func packetFilter() (ebpf.Filter, error) {
+	expr := packetFilterExpr
+	if packetFilterFile != "" {
+		data, err := os.ReadFile(packetFilterFile)
+		if err != nil {
+			return ebpf.Filter{}, err
+		}
+		expr += " " + string(data)
+	}
+	filter, err := ebpf.ParseFilter(expr)
 	if err != nil {
-		found = false
+		return ebpf.Filter{}, err
+	}
+	if srcPort != 0 {
+		filter.AddPort(uint16(srcPort), ebpf.SIDE_SRC)
+	}
+	if destPort != 0 {
+		filter.AddPort(uint16(destPort), ebpf.SIDE_DST)
+	}
+	return filter, nil
+}
+
+// reloadPacketFilter reads the filter again and replaces the one of the
+// running packet tracer. A filter that does not parse leaves the old one.
+func reloadPacketFilter() error {
+	packetTracerMu.Lock()
+	defer packetTracerMu.Unlock()
+	if currentPacketTracer == nil {
+		return fmt.Errorf("no packet tracer is running")
+	}
+	setter, ok := currentPacketTracer.(filterSetter)
+	if !ok {
+		return fmt.Errorf("the %s backend cannot change its filter", netBackend)
+	}
+	filter, err := packetFilter()
+	if err != nil {
+		return err
+	}
+	directions, err := packetDirections()
+	if err != nil {
+		return err
+	}
+	if netBackend == "socket" && len(directions) == 1 {
+		filter.AddDirection(directions[0])
+	}
+	return setter.SetFilter(filter)
+}
+
+func targetSpec(exeName string, pid int) pkg.TargetSpec {
+	name := exeName
+	if name == "NOTSET" {
+		name = ""
+	}
+	return pkg.TargetSpec{Name: name, PID: pid, ContainerID: containerID, PIDNamespace: pidNamespace}
+}
+
+// newOgomon finds the target and starts monitoring it. It returns false when a
+// signal on dieSignalChan stopped the search first.
+func newOgomon(exeName string, pid int, notFoundChan chan bool, cancelChan chan bool, dieSignalChan <-chan os.Signal, appendFile bool) bool {
+	spec := targetSpec(exeName, pid)
+	fs, _ := procfs.NewDefaultFS()
+	var proc procfs.Proc
+	var err error
+	if waitForTarget {
+		jww.INFO.Println("Waiting for target process")
+		proc, err = waitTarget(spec, dieSignalChan)
+		if errors.Is(err, pkg.ErrWaitCancelled) {
+			return false
+		}
+		if err != nil {
+			jww.ERROR.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		found := false
 		for c := 0; c < 3; c++ {
-			proc, err = pkg.GetTargetProc(exeName, pid)
+			proc, err = spec.Find()
 			if err == nil {
 				found = true
 				break
 			} else {
 				jww.ERROR.Println(err)
-				time.Sleep(1 * time.Second)
+				select {
+				case <-dieSignalChan:
+					return false
+				case <-time.After(1 * time.Second):
+				}
 			}
 		}
 		if !found {
 			os.Exit(1)
 		}
 	}
+	currentProc = proc
+	session.NewGeneration(proc.PID)
+	if nsPids, err := pkg.NSpids(procfs.DefaultMountPoint, proc.PID); err == nil {
+		session.SetGeneration("ns_pid", nsPids[len(nsPids)-1])
+		session.SetGeneration("ns_pids", strings.Trim(fmt.Sprint(nsPids), "[]"))
+	}
 	go func(process procfs.Proc) {
-		var errTarget *os.PathError
-		for {
-			_, err := process.Comm()
-			if err != nil && errors.As(err, &errTarget) {
-				notFoundChan <- true
-				jww.INFO.Println("Process Closed")
-				break
-			}
+		exit, err := pkg.WaitProcessExit(process.PID)
+		if err != nil {
+			jww.ERROR.Println(err)
 		}
+		// Recorded before notifying control, which tears the tracers down.
+		session.RecordExit(exit)
+		jww.INFO.Println("Process Closed")
+		notFoundChan <- true
 	}(proc)
+	controlWg.Add(1)
 	go monitorProcess(proc, fs, cancelChan, appendFile)
+	return true
+}
+
+// waitTarget runs pkg.WaitForTarget in the background so that a signal on
+// dieSignalChan stops the wait.
+func waitTarget(spec pkg.TargetSpec, dieSignalChan <-chan os.Signal) (procfs.Proc, error) {
+	type waitResult struct {
+		proc procfs.Proc
+		err  error
+	}
+	cancel := make(chan struct{})
+	done := make(chan waitResult, 1)
+	go func() {
+		proc, err := pkg.WaitForTarget(spec, waitTimeout, cancel)
+		done <- waitResult{proc, err}
+	}()
+	select {
+	case result := <-done:
+		return result.proc, result.err
+	case <-dieSignalChan:
+		jww.INFO.Println("Stopped waiting for target process")
+		close(cancel)
+		<-done
+		return procfs.Proc{}, pkg.ErrWaitCancelled
+	}
 }
 
 func ogomonControl(exeName string, pid int) {
-	dieSignalChan := make(chan os.Signal)
+	var err error
+	session, err = internal.NewSession(false)
+	if err != nil {
+		jww.ERROR.Fatalln(err)
+	}
+	defer session.Close()
+	dieSignalChan := make(chan os.Signal, 1)
 	notFoundChan := make(chan bool)
-	signal.Notify(dieSignalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	signal.Notify(dieSignalChan, syscall.SIGINT, syscall.SIGTERM)
+	snapshotSignalChan := make(chan os.Signal, 1)
+	signal.Notify(snapshotSignalChan, syscall.SIGUSR1)
+	reloadSignalChan := make(chan os.Signal, 1)
+	signal.Notify(reloadSignalChan, syscall.SIGHUP)
 	cancelChan := make(chan bool)
-	controlWg.Add(1)
-	newOgomon(exeName, pid, notFoundChan, cancelChan, false)
+	if !newOgomon(exeName, pid, notFoundChan, cancelChan, dieSignalChan, false) {
+		return
+	}
 	LOOP:
 	for {
 		select {
 		case <- dieSignalChan:
 			cancelChan <- true
-			close(dieSignalChan)
-			close(notFoundChan)
+			signal.Stop(dieSignalChan)
 			// WAIT FOR OGOMONG TO END
 			controlWg.Wait()
 			break LOOP
+		case <- snapshotSignalChan:
+			filename, err := internal.WriteSmapsSnapshot(&currentProc)
+			if err != nil {
+				jww.ERROR.Println(err)
+			} else {
+				session.LogEvent("smaps_snapshot", "%s", filename)
+			}
+		case <- reloadSignalChan:
+			if err := reloadPacketFilter(); err != nil {
+				jww.ERROR.Println("Filter not reloaded: ", err)
+			} else {
+				jww.INFO.Println("Filter reloaded")
+				session.LogEvent("filter_reload", "%s", packetFilterFile)
+			}
 		case <- notFoundChan:
 			cancelChan <- true
-			newOgomon(exeName, pid, notFoundChan, cancelChan, true)
-			
+			// The previous generation must flush and close its files before the next one appends.
+			controlWg.Wait()
+			if !newOgomon(exeName, pid, notFoundChan, cancelChan, dieSignalChan, true) {
+				break LOOP
+			}
 		}
 	}
 }
@@ -186,10 +456,30 @@ var monitorCmd = &cobra.Command{
 	Short: "memory and disk",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		jww.INFO.Println("Monitor Starting")
-		if pid == -1 && executableName == "NOTSET" {
+		if pid == -1 && executableName == "NOTSET" && containerID == "" {
 			jww.ERROR.Println("NO PID AND EXE")
 			os.Exit(1)
 		}
+		if wholeContainer && containerID == "" {
+			jww.ERROR.Println("--whole-container needs --container")
+			os.Exit(1)
+		}
+		if _, err := packetDirections(); err != nil {
+			jww.ERROR.Println(err)
+			os.Exit(1)
+		}
+		if _, err := packetFilter(); err != nil {
+			jww.ERROR.Println(err)
+			os.Exit(1)
+		}
+		if netBackend == "xdp" && packetDirection == "egress" {
+			jww.ERROR.Println("The xdp backend only captures ingress packets")
+			os.Exit(1)
+		}
+		if packetAttribution != "none" && netBackend != "tc" && !(netBackend == "xdp" && packetAttribution == "socket") {
+			jww.ERROR.Println("--attribute needs --net-backend tc, or xdp with socket attribution")
+			os.Exit(1)
+		}
 		ogomonControl(executableName, pid)
 		return nil
 	},
@@ -199,7 +489,21 @@ func init() {
 	monitorCmd.Flags().StringVarP(&deviceName, "device-name", "d", "", "Interface Name")
 	monitorCmd.Flags().IntVarP(&srcPort, "src-port", "s", 0, "Set Source Port")
 	monitorCmd.Flags().IntVarP(&destPort, "dest-port", "t", 0, "Set Destination Port")
+	monitorCmd.Flags().StringVar(&netBackend, "net-backend", "pfring", "Packet capture backend: pfring, socket, tc, xdp (ingress only) or none")
+	monitorCmd.Flags().StringVar(&packetDirection, "direction", "both", "Packets to capture: ingress, egress or both")
+	monitorCmd.Flags().StringVar(&packetAttribution, "attribute", "none", "Keep only the target's packets, by its socket cookies (socket) or cgroup (cgroup), tc backend or xdp with socket")
+	monitorCmd.Flags().BoolVar(&packetEvents, "packet-events", false, "Record every packet, and TCP retransmissions and round trip times, in addition to per flow records, socket, tc and xdp backends")
+	monitorCmd.Flags().StringVar(&packetFilterExpr, "filter", "", "Packets to record, e.g. \"proto=tcp port=80,8000-8080 net=10.0.0.0/8 dir=ingress\"")
+	monitorCmd.Flags().StringVar(&packetFilterFile, "filter-file", "", "File of more --filter terms, read again on SIGHUP to change the filter of the socket, tc and xdp backends")
 	monitorCmd.Flags().StringVarP(&executableName, "executable", "e", "NOTSET", "Name to trace")
 	monitorCmd.Flags().IntVarP(&pid, "pid", "p", -1, "PID to trace")
+	monitorCmd.Flags().StringVarP(&containerID, "container", "c", "", "Container ID to trace, its main process unless --executable or --pid (inside the container) picks another")
+	monitorCmd.Flags().BoolVar(&wholeContainer, "whole-container", false, "Also record the processes of the --container summed together")
+	monitorCmd.Flags().StringVar(&pidNamespace, "pid-ns", "", "Read --pid inside this pid namespace, e.g. /proc/<pid>/ns/pid")
+	monitorCmd.Flags().BoolVarP(&waitForTarget, "wait", "w", false, "Wait for the target process to start")
+	monitorCmd.Flags().DurationVar(&waitTimeout, "wait-timeout", 0, "Give up waiting for the target after this long, 0 waits forever")
+	monitorCmd.Flags().DurationVar(&smapsInterval, "smaps-interval", internal.SMAPS_TICKER_TIME, "Interval of the smaps_rollup tracer, send SIGUSR1 for a full smaps snapshot")
+	monitorCmd.Flags().DurationVar(&fdLeakWindow, "fd-leak-window", internal.FD_LEAK_WINDOW, "Report a descriptor leak when the fd count grows for this long")
+	monitorCmd.Flags().StringSliceVar(&blockDevices, "block-devices", nil, "Block devices to record, by default the ones backing the target's cwd and open files")
 	rootCmd.AddCommand(monitorCmd)
 }
@@ -5,13 +5,15 @@
 
 #include <stddef.h>
 
-// #include <linux/if_packet.h>
+#include <linux/if_packet.h> // PACKET_OUTGOING
 
 #include <linux/in.h>		// proto type
 #include <linux/if_ether.h> // l2
 #include <linux/ip.h>		// l3
+#include <linux/ipv6.h>		// l3
 #include <linux/tcp.h>		// l4 struct tcphdr
 #include <linux/udp.h>		// l4 struct udphdr
+#include <linux/icmp.h>		// l4 struct icmphdr
 
 #include <linux/bpf.h>
 
@@ -23,86 +25,697 @@
 #define INGRESS 1
 #define EGRESS 2
 
+#define AF_INET 2
+#define AF_INET6 10
+
+#define IP_OFFSET 0x1FFF // fragment offset part of iphdr frag_off
+#define NO_L4HDR 0 // parse_iphdr result for packets without a transport header
+#define TCP_FLAGS_OFFSET 13 // byte of tcphdr holding the flags
+
+// filter_config flags, a packet must match every enabled kind of filter.
+#define FILTER_PORTS (1 << 0)
+#define FILTER_NETS (1 << 1)
+#define FILTER_PROTOCOLS (1 << 2)
+#define FILTER_DIRECTIONS (1 << 3)
+
+// Which end of the flow a port or net filter applies to.
+#define SIDE_SRC (1 << 0)
+#define SIDE_DST (1 << 1)
+
+#define MAX_PORT_RANGES 16
+
+// filter_config attribution, which packets belong to the monitored process.
+#define ATTRIBUTE_NONE 0
+#define ATTRIBUTE_SOCKET 1
+#define ATTRIBUTE_CGROUP 2
+
+// report_config flags, flows are aggregated in the kernel and per packet
+// events are opt-in for lower packet rates.
+#define REPORT_EVENTS (1 << 0)
+#define REPORT_FLOWS (1 << 1)
+
+// Packet size histogram buckets, bucket n counts sizes in [2^n, 2^(n+1)) and
+// the last one everything larger.
+#define FLOW_SIZE_BUCKETS 20
+
+// lost_events entries.
+#define LOST_EVENTS 0
+#define LOST_FLOWS 1
+
+// Extension headers walked before giving up on finding the transport header.
+#define MAX_IPV6_EXT_HEADERS 6
+
+// Kinds of program, known at compile time in each so the code paths and
+// helpers of the others are left out.
+#define PROG_SOCKET 0
+#define PROG_TC 1
+#define PROG_XDP 2
+
+// XDP headers are read within this many bytes of the frame start, it must be
+// a mask for the verifier to bound the offset.
+#define XDP_OFFSET_MAX 0x1ff
+
 #define NIPQUAD(addr) \
     ((unsigned char *)&addr)[0], \
     ((unsigned char *)&addr)[1], \
     ((unsigned char *)&addr)[2], \
     ((unsigned char *)&addr)[3]
 
-static __always_inline int parse_tcphdr(struct iphdr *iphdr_l3, struct tcphdr *tcphdr_l4, struct __sk_buff *skb)
-{
-
-	if (bpf_skb_load_bytes(skb, sizeof(struct ethhdr) + sizeof(struct iphdr), tcphdr_l4, sizeof(struct tcphdr)) < 0) {
-	    return -1;
-	}
-	if (bpf_skb_load_bytes(skb, sizeof(struct ethhdr), iphdr_l3, sizeof(struct iphdr)) < 0) {
-	    return -1;
-	}
-	return 1;
-}
-
 struct event {
+    __u64 ts;
     __u64 sport;
     __u64 dport;
     __u64 len;
 	__u64 direction;
-	__u64 saddr;
-	__u64 daddr;
+	__u8 saddr[16]; // IPv4 addresses use the first 4 bytes
+	__u8 daddr[16];
+	__u64 family; // AF_INET or AF_INET6
+	__u64 protocol; // IPPROTO_*, ICMP type and code are stored in sport and dport
+	// TCP header fields, zero for other protocols. payload_len excludes the
+	// IP and TCP headers and link layer padding.
+	__u32 seq;
+	__u32 ack_seq;
+	__u32 payload_len;
+	__u16 window;
+	__u8 tcp_flags; // FIN, SYN, RST, PSH, ACK, URG, ECE, CWR from bit 0
+	__u8 pad;
 };
 struct event *unused __attribute__((unused));
 
+// Events are streamed through a ring buffer, or on kernels older than 5.8
+// through a perf event array, see report_packet_size_perf.
 struct bpf_map_def SEC("maps") events = {
+	.type = BPF_MAP_TYPE_RINGBUF,
+	.max_entries = 1 << 24,
+};
+
+struct bpf_map_def SEC("maps") perf_events = {
+	.type = BPF_MAP_TYPE_PERF_EVENT_ARRAY,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(__u32),
+};
+
+// Events that could not be submitted because the buffer was full, and packets
+// not counted because the flows map was full.
+struct bpf_map_def SEC("maps") lost_events = {
+	.type = BPF_MAP_TYPE_PERCPU_ARRAY,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(__u64),
+	.max_entries = 2,
+};
+
+struct flow_key {
+	__u8 saddr[16];
+	__u8 daddr[16];
+	__u16 sport;
+	__u16 dport;
+	__u8 protocol;
+	__u8 direction;
+	__u8 family;
+	__u8 pad;
+};
+struct flow_key *unused_flow_key __attribute__((unused));
+
+struct flow_stats {
+	__u64 packets;
+	__u64 bytes;
+	__u64 first_seen;
+	__u64 last_seen;
+	__u64 sizes[FLOW_SIZE_BUCKETS];
+};
+struct flow_stats *unused_flow_stats __attribute__((unused));
+
+// Flows seen since user space last read and removed them.
+struct bpf_map_def SEC("maps") flows = {
 	.type = BPF_MAP_TYPE_HASH,
-	.key_size = sizeof(__u64),
-	.value_size = sizeof(struct event),
-	.max_entries = 100000,
+	.key_size = sizeof(struct flow_key),
+	.value_size = sizeof(struct flow_stats),
+	.max_entries = 65536,
+};
+
+struct bpf_map_def SEC("maps") report_config = {
+	.type = BPF_MAP_TYPE_ARRAY,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(__u32),
+	.max_entries = 1,
+};
+
+struct filter_config {
+	__u32 flags;
+	__u32 directions; // bit 1 << direction set for the directions reported
+	__u32 port_ranges; // entries in use in filter_port_ranges
+	__u32 attribution;
+	__u64 cgroup_id; // cgroup v2 id of the target for ATTRIBUTE_CGROUP
+};
+
+struct port_range {
+	__u16 from;
+	__u16 to;
+	__u32 sides;
+};
+
+// Keys of filter_nets, the family is part of the prefix so IPv4 and IPv6
+// networks never match each other.
+struct net_key {
+	__u32 prefixlen;
+	__u8 family;
+	__u8 addr[16];
+};
+
+// The filter is written from user space and may change while the program is
+// attached. filter_config is written last, so it only enables filters whose
+// entries are in place.
+struct bpf_map_def SEC("maps") filter_config = {
+	.type = BPF_MAP_TYPE_ARRAY,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(struct filter_config),
+	.max_entries = 1,
+};
+
+// Single ports, the value holds the SIDE_* bits the port matches on.
+struct bpf_map_def SEC("maps") filter_ports = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u16),
+	.value_size = sizeof(__u32),
+	.max_entries = 1024,
+};
+
+struct bpf_map_def SEC("maps") filter_port_ranges = {
+	.type = BPF_MAP_TYPE_ARRAY,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(struct port_range),
+	.max_entries = MAX_PORT_RANGES,
+};
+
+// Networks, the value holds the SIDE_* bits of the longest matching prefix.
+struct bpf_map_def SEC("maps") filter_nets = {
+	.type = BPF_MAP_TYPE_LPM_TRIE,
+	.key_size = sizeof(struct net_key),
+	.value_size = sizeof(__u32),
+	.max_entries = 1024,
+	.map_flags = BPF_F_NO_PREALLOC,
+};
+
+// Non zero for the IPPROTO_* numbers reported.
+struct bpf_map_def SEC("maps") filter_protocols = {
+	.type = BPF_MAP_TYPE_ARRAY,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(__u8),
+	.max_entries = 256,
 };
 
-struct bpf_map_def SEC("maps") port_holder = {
+// Socket cookies of the target's sockets, kept in sync by user space.
+struct bpf_map_def SEC("maps") target_sockets = {
 	.type = BPF_MAP_TYPE_HASH,
 	.key_size = sizeof(__u64),
-	.value_size = sizeof(__u64),
-	.max_entries = 2,
+	.value_size = sizeof(__u8),
+	.max_entries = 16384,
+};
+
+// Flows of the target keyed as their ingress packets, with direction 0. Only
+// egress packets carry the socket, so ingress ones are attributed by the flows
+// the target sent on, or that user space found among its sockets.
+struct bpf_map_def SEC("maps") target_flows = {
+	.type = BPF_MAP_TYPE_LRU_HASH,
+	.key_size = sizeof(struct flow_key),
+	.value_size = sizeof(__u8),
+	.max_entries = 65536,
 };
 
-static __always_inline int create_ev(struct tcphdr *tcphdr_l4, struct iphdr *iphdr_l3, struct event* ev)
+// load_bytes copies len bytes at offset off of the packet, from the skb or
+// from the linear buffer of an XDP frame.
+static __always_inline int load_bytes(void *ctx, int prog, __u32 off, void *to, const __u32 len)
+{
+	if (prog != PROG_XDP) {
+	    return bpf_skb_load_bytes(ctx, off, to, len);
+	}
+	if (off > XDP_OFFSET_MAX) {
+	    return -1;
+	}
+	struct xdp_md *xdp = ctx;
+	void *data = (void *)(long)xdp->data;
+	void *data_end = (void *)(long)xdp->data_end;
+	void *from = data + (off & XDP_OFFSET_MAX);
+	if (from + len > data_end) {
+	    return -1;
+	}
+	__builtin_memcpy(to, from, len);
+	return 0;
+}
+
+static __always_inline int parse_ipv4(void *ctx, int prog, struct event *ev, __u8 *proto, __u32 *end)
+{
+	struct iphdr iphdr_l3;
+
+	if (load_bytes(ctx, prog, ETH_HLEN, &iphdr_l3, sizeof(struct iphdr)) < 0) {
+	    return -1;
+	}
+	if (iphdr_l3.ihl < 5) {
+	    return -1;
+	}
+	__builtin_memcpy(ev->saddr, &iphdr_l3.saddr, sizeof(iphdr_l3.saddr));
+	__builtin_memcpy(ev->daddr, &iphdr_l3.daddr, sizeof(iphdr_l3.daddr));
+	ev->family = AF_INET;
+	*proto = iphdr_l3.protocol;
+	*end = ETH_HLEN + bpf_ntohs(iphdr_l3.tot_len);
+	if (iphdr_l3.frag_off & bpf_htons(IP_OFFSET)) {
+	    return NO_L4HDR;
+	}
+	return ETH_HLEN + iphdr_l3.ihl * 4;
+}
+
+// parse_ipv6 copies the addresses of an IPv6 packet into ev and returns the
+// offset of the transport header, following the next header chain through
+// hop-by-hop, routing, destination options, fragment and authentication
+// headers.
+static __always_inline int parse_ipv6(void *ctx, int prog, struct event *ev, __u8 *proto, __u32 *end)
+{
+	struct ipv6hdr ipv6hdr_l3;
+	struct ipv6_opt_hdr opt;
+	struct frag_hdr frag;
+	int offset = ETH_HLEN + sizeof(struct ipv6hdr);
+	__u8 nexthdr;
+
+	if (load_bytes(ctx, prog, ETH_HLEN, &ipv6hdr_l3, sizeof(struct ipv6hdr)) < 0) {
+	    return -1;
+	}
+	__builtin_memcpy(ev->saddr, &ipv6hdr_l3.saddr, sizeof(ipv6hdr_l3.saddr));
+	__builtin_memcpy(ev->daddr, &ipv6hdr_l3.daddr, sizeof(ipv6hdr_l3.daddr));
+	ev->family = AF_INET6;
+	nexthdr = ipv6hdr_l3.nexthdr;
+	*end = ETH_HLEN + sizeof(struct ipv6hdr) + bpf_ntohs(ipv6hdr_l3.payload_len);
+
+#pragma unroll
+	for (int i = 0; i < MAX_IPV6_EXT_HEADERS; i++) {
+	    switch (nexthdr) {
+	    case NEXTHDR_HOP:
+	    case NEXTHDR_ROUTING:
+	    case NEXTHDR_DEST:
+		if (load_bytes(ctx, prog, offset, &opt, sizeof(opt)) < 0) {
+		    return -1;
+		}
+		nexthdr = opt.nexthdr;
+		offset += (opt.hdrlen + 1) * 8;
+		break;
+	    case NEXTHDR_AUTH:
+		if (load_bytes(ctx, prog, offset, &opt, sizeof(opt)) < 0) {
+		    return -1;
+		}
+		nexthdr = opt.nexthdr;
+		offset += (opt.hdrlen + 2) * 4;
+		break;
+	    case NEXTHDR_FRAGMENT:
+		if (load_bytes(ctx, prog, offset, &frag, sizeof(frag)) < 0) {
+		    return -1;
+		}
+		nexthdr = frag.nexthdr;
+		if (frag.frag_off & bpf_htons(IPV6_FRAG_OFFSET)) {
+		    *proto = nexthdr;
+		    return NO_L4HDR;
+		}
+		offset += sizeof(struct frag_hdr);
+		break;
+	    case NEXTHDR_NONE:
+		return -1;
+	    default:
+		*proto = nexthdr;
+		return offset;
+	    }
+	}
+	return -1;
+}
+
+// parse_iphdr fills the addresses and family of ev and returns the offset of
+// the transport header, NO_L4HDR for fragments other than the first, which
+// carry none, or -1 when the frame is not IP or cannot be parsed. end is set to
+// the offset where the IP packet ends.
+static __always_inline int parse_iphdr(void *ctx, int prog, struct event *ev, __u8 *proto, __u32 *end)
+{
+	__be16 h_proto;
+
+	if (load_bytes(ctx, prog, offsetof(struct ethhdr, h_proto), &h_proto, sizeof(h_proto)) < 0) {
+	    return -1;
+	}
+	switch (h_proto) {
+	case bpf_htons(ETH_P_IP):
+	    return parse_ipv4(ctx, prog, ev, proto, end);
+	case bpf_htons(ETH_P_IPV6):
+	    return parse_ipv6(ctx, prog, ev, proto, end);
+	}
+	return -1;
+}
+
+static __always_inline int parse_tcphdr(void *ctx, int prog, int offset, __u32 end, struct event *ev)
+{
+	struct tcphdr tcphdr_l4;
+
+	if (load_bytes(ctx, prog, offset, &tcphdr_l4, sizeof(struct tcphdr)) < 0) {
+	    return -1;
+	}
+	ev->sport = bpf_ntohs(tcphdr_l4.source);
+	ev->dport = bpf_ntohs(tcphdr_l4.dest);
+	ev->seq = bpf_ntohl(tcphdr_l4.seq);
+	ev->ack_seq = bpf_ntohl(tcphdr_l4.ack_seq);
+	ev->window = bpf_ntohs(tcphdr_l4.window);
+	ev->tcp_flags = ((__u8 *)&tcphdr_l4)[TCP_FLAGS_OFFSET];
+
+	__u32 payload = offset + tcphdr_l4.doff * 4;
+	if (end > payload) {
+	    ev->payload_len = end - payload;
+	}
+	return 1;
+}
+
+static __always_inline int parse_udphdr(void *ctx, int prog, int offset, struct event *ev)
+{
+	struct udphdr udphdr_l4;
+
+	if (load_bytes(ctx, prog, offset, &udphdr_l4, sizeof(struct udphdr)) < 0) {
+	    return -1;
+	}
+	ev->sport = bpf_ntohs(udphdr_l4.source);
+	ev->dport = bpf_ntohs(udphdr_l4.dest);
+	return 1;
+}
+
+// parse_icmphdr handles ICMP and ICMPv6, which share the type and code layout.
+static __always_inline int parse_icmphdr(void *ctx, int prog, int offset, struct event *ev)
 {
-    __u64 target_source = 0, target_dest = 0;
-    target_source = tcphdr_l4->source;
-    target_dest = tcphdr_l4->dest;
-    __u64 saddr = ((unsigned char*)(&(iphdr_l3->saddr)))[3];
-    __u64 daddr = ((unsigned char*)(&(iphdr_l3->daddr)))[3];
-    ev->sport = bpf_ntohs(target_source);
-    ev->dport = bpf_ntohs(target_dest);
-    ev->saddr = saddr;
-    ev->daddr = daddr;
+	struct icmphdr icmphdr_l4;
+
+	if (load_bytes(ctx, prog, offset, &icmphdr_l4, 2) < 0) {
+	    return -1;
+	}
+	ev->sport = icmphdr_l4.type;
+	ev->dport = icmphdr_l4.code;
+	return 1;
+}
+
+// parse_l4hdr fills the ports, or ICMP type and code, of ev. Other transport
+// protocols, and fragments past the first, are reported without ports.
+static __always_inline int parse_l4hdr(void *ctx, int prog, int offset, __u32 end, __u8 proto, struct event *ev)
+{
+	ev->protocol = proto;
+	if (offset == NO_L4HDR) {
+	    return 1;
+	}
+	switch (proto) {
+	case IPPROTO_TCP:
+	    return parse_tcphdr(ctx, prog, offset, end, ev);
+	case IPPROTO_UDP:
+	case IPPROTO_UDPLITE:
+	    return parse_udphdr(ctx, prog, offset, ev);
+	case IPPROTO_ICMP:
+	case NEXTHDR_ICMP:
+	    return parse_icmphdr(ctx, prog, offset, ev);
+	}
+	return 1;
+}
+
+static __always_inline void count_lost(__u32 key)
+{
+    __u64 *lost = bpf_map_lookup_elem(&lost_events, &key);
+    if (lost) {
+	    (*lost)++;
+    }
+}
+
+static __always_inline int create_ev(void *ctx, int prog, struct event *ev)
+{
+    __u8 proto;
+    __u32 end;
+    ev->ts = bpf_ktime_get_ns();
+    if (prog == PROG_XDP) {
+	    struct xdp_md *xdp = ctx;
+	    ev->len = xdp->data_end - xdp->data;
+	    ev->direction = INGRESS;
+    } else {
+	    struct __sk_buff *skb = ctx;
+	    ev->len = skb->len;
+	    ev->direction = skb->pkt_type == PACKET_OUTGOING ? EGRESS : INGRESS;
+    }
+
+    int offset = parse_iphdr(ctx, prog, ev, &proto, &end);
+    if (offset < 0) {
+	    return -1;
+    }
+    return parse_l4hdr(ctx, prog, offset, end, proto, ev);
+}
+
+static __always_inline int has_ports(struct event *ev)
+{
+    return ev->protocol == IPPROTO_TCP || ev->protocol == IPPROTO_UDP || ev->protocol == IPPROTO_UDPLITE;
+}
+
+static __always_inline int match_port(__u16 port, __u32 side)
+{
+    __u32 *sides = bpf_map_lookup_elem(&filter_ports, &port);
+    return sides && (*sides & side);
+}
+
+static __always_inline int match_ports(struct filter_config *config, struct event *ev)
+{
+    if (!has_ports(ev)) {
+	    return 0;
+    }
+    if (match_port(ev->sport, SIDE_SRC) || match_port(ev->dport, SIDE_DST)) {
+	    return 1;
+    }
+#pragma unroll
+    for (__u32 i = 0; i < MAX_PORT_RANGES; i++) {
+	    if (i >= config->port_ranges) {
+		    break;
+	    }
+	    __u32 key = i;
+	    struct port_range *range = bpf_map_lookup_elem(&filter_port_ranges, &key);
+	    if (!range) {
+		    break;
+	    }
+	    if ((range->sides & SIDE_SRC) && ev->sport >= range->from && ev->sport <= range->to) {
+		    return 1;
+	    }
+	    if ((range->sides & SIDE_DST) && ev->dport >= range->from && ev->dport <= range->to) {
+		    return 1;
+	    }
+    }
+    return 0;
+}
+
+static __always_inline int match_net(struct event *ev, __u8 *addr, __u32 side)
+{
+    struct net_key key = {
+	    .prefixlen = 8 + (ev->family == AF_INET ? 32 : 128),
+	    .family = ev->family,
+    };
+    __builtin_memcpy(key.addr, addr, sizeof(key.addr));
+    __u32 *sides = bpf_map_lookup_elem(&filter_nets, &key);
+    return sides && (*sides & side);
+}
+
+// match_target tells whether ev belongs to the target. Socket filters may not
+// read the cgroup id and XDP frames have no socket yet, prog leaves those
+// helpers out of the programs that cannot call them.
+static __always_inline int match_target(void *ctx, int prog, struct filter_config *config, struct event *ev)
+{
+    struct flow_key key = {
+	    .protocol = ev->protocol,
+	    .family = ev->family,
+    };
+    if (prog == PROG_XDP || ev->direction == INGRESS) {
+	    key.sport = ev->sport;
+	    key.dport = ev->dport;
+	    __builtin_memcpy(key.saddr, ev->saddr, sizeof(key.saddr));
+	    __builtin_memcpy(key.daddr, ev->daddr, sizeof(key.daddr));
+	    return bpf_map_lookup_elem(&target_flows, &key) != NULL;
+    }
+
+    int owned = 0;
+    if (config->attribution == ATTRIBUTE_SOCKET) {
+	    __u64 cookie = bpf_get_socket_cookie(ctx);
+	    owned = cookie && bpf_map_lookup_elem(&target_sockets, &cookie);
+    } else if (prog == PROG_TC && config->attribution == ATTRIBUTE_CGROUP) {
+	    owned = bpf_skb_cgroup_id(ctx) == config->cgroup_id;
+    }
+    if (owned) {
+	    __u8 value = 1;
+	    key.sport = ev->dport;
+	    key.dport = ev->sport;
+	    __builtin_memcpy(key.saddr, ev->daddr, sizeof(key.saddr));
+	    __builtin_memcpy(key.daddr, ev->saddr, sizeof(key.daddr));
+	    bpf_map_update_elem(&target_flows, &key, &value, BPF_ANY);
+    }
+    return owned;
+}
+
+// filter_event tells whether ev passes the filter written by user space.
+static __always_inline int filter_event(void *ctx, int prog, struct event *ev)
+{
+    __u32 key = 0;
+    struct filter_config *config = bpf_map_lookup_elem(&filter_config, &key);
+    if (!config || (!config->flags && !config->attribution)) {
+	    return 1;
+    }
+    if ((config->flags & FILTER_DIRECTIONS) && !(config->directions & (1 << ev->direction))) {
+	    return 0;
+    }
+    if (config->flags & FILTER_PROTOCOLS) {
+	    __u32 proto = ev->protocol;
+	    __u8 *allowed = bpf_map_lookup_elem(&filter_protocols, &proto);
+	    if (!allowed || !*allowed) {
+		    return 0;
+	    }
+    }
+    if ((config->flags & FILTER_PORTS) && !match_ports(config, ev)) {
+	    return 0;
+    }
+    if ((config->flags & FILTER_NETS) && !match_net(ev, ev->saddr, SIDE_SRC) && !match_net(ev, ev->daddr, SIDE_DST)) {
+	    return 0;
+    }
+    if (config->attribution && !match_target(ctx, prog, config, ev)) {
+	    return 0;
+    }
     return 1;
 }
 
-SEC("socket")
-int report_packet_size(struct __sk_buff *skb)
+static __always_inline __u32 log2_u32(__u32 v)
 {
-    __u64 src_key = 0;
-    __u64 dest_key = 1;
-    __u64 *src_ip = bpf_map_lookup_elem(&port_holder, &src_key);
-    __u64 *dest_ip = bpf_map_lookup_elem(&port_holder, &dest_key);
-
-    __u64 val = skb->len;
-    __u64 key = bpf_ktime_get_ns();
-	
-    int proto_type;
-    struct iphdr iphdr_l3;
-    struct tcphdr tcphdr_l4;
-    struct event ev = {.len = val};
-    
-    // NO UDP SUPPORT FOR NOW
-    if (parse_tcphdr(&iphdr_l3, &tcphdr_l4, skb)) {
-	    if (create_ev(&tcphdr_l4, &iphdr_l3, &ev) > 0) {
-		    bpf_map_update_elem(&events, &key, &ev, BPF_ANY);
+    __u32 r, shift;
+
+    r = (v > 0xFFFF) << 4; v >>= r;
+    shift = (v > 0xFF) << 3; v >>= shift; r |= shift;
+    shift = (v > 0xF) << 2; v >>= shift; r |= shift;
+    shift = (v > 0x3) << 1; v >>= shift; r |= shift;
+    r |= (v >> 1);
+    return r;
+}
+
+// count_flow adds the packet of ev to its flow. Counters are updated atomically
+// since the flow may be hit from several cpus at once.
+static __always_inline void count_flow(struct event *ev)
+{
+    struct flow_key key = {
+	    .sport = ev->sport,
+	    .dport = ev->dport,
+	    .protocol = ev->protocol,
+	    .direction = ev->direction,
+	    .family = ev->family,
+    };
+    __builtin_memcpy(key.saddr, ev->saddr, sizeof(key.saddr));
+    __builtin_memcpy(key.daddr, ev->daddr, sizeof(key.daddr));
+
+    struct flow_stats *stats = bpf_map_lookup_elem(&flows, &key);
+    if (!stats) {
+	    struct flow_stats new_stats = {.first_seen = ev->ts};
+	    // Fails with EEXIST when another cpu created the flow first.
+	    bpf_map_update_elem(&flows, &key, &new_stats, BPF_NOEXIST);
+	    stats = bpf_map_lookup_elem(&flows, &key);
+	    if (!stats) {
+		    count_lost(LOST_FLOWS);
+		    return;
 	    }
     }
 
+    __u32 bucket = log2_u32(ev->len);
+    if (bucket >= FLOW_SIZE_BUCKETS) {
+	    bucket = FLOW_SIZE_BUCKETS - 1;
+    }
+    __sync_fetch_and_add(&stats->packets, 1);
+    __sync_fetch_and_add(&stats->bytes, ev->len);
+    __sync_fetch_and_add(&stats->sizes[bucket], 1);
+    stats->last_seen = ev->ts;
+}
+
+// report counts the packet of ctx in its flow and emits an event for it, as
+// configured in report_config, when it passes the filter. direction is set by
+// the tc programs, socket filters tell the direction from the packet type and
+// XDP only sees ingress.
+static __always_inline int report(void *ctx, int prog, __u64 direction, int perf)
+{
+    struct event ev = {};
+
+    if (create_ev(ctx, prog, &ev) < 0) {
+	    return 0;
+    }
+    if (direction) {
+	    ev.direction = direction;
+    }
+    if (!filter_event(ctx, prog, &ev)) {
+	    return 0;
+    }
+    __u32 key = 0;
+    __u32 *flags = bpf_map_lookup_elem(&report_config, &key);
+    if (!flags) {
+	    return 0;
+    }
+    if (*flags & REPORT_FLOWS) {
+	    count_flow(&ev);
+    }
+    if (!(*flags & REPORT_EVENTS)) {
+	    return 0;
+    }
+    long err;
+    if (perf) {
+	    err = bpf_perf_event_output(ctx, &perf_events, BPF_F_CURRENT_CPU, &ev, sizeof(ev));
+    } else {
+	    err = bpf_ringbuf_output(&events, &ev, sizeof(ev), 0);
+    }
+    if (err < 0) {
+	    count_lost(LOST_EVENTS);
+    }
     return 0;
 }
 
+// Returning 0 never drops packets, it is TC_ACT_OK for the tc programs and
+// only truncates the copy a socket filter passes to its own socket.
+SEC("socket")
+int report_packet_size(struct __sk_buff *skb)
+{
+    return report(skb, PROG_SOCKET, 0, 0);
+}
+
+SEC("classifier")
+int report_ingress(struct __sk_buff *skb)
+{
+    return report(skb, PROG_TC, INGRESS, 0);
+}
+
+SEC("classifier")
+int report_egress(struct __sk_buff *skb)
+{
+    return report(skb, PROG_TC, EGRESS, 0);
+}
+
+SEC("socket")
+int report_packet_size_perf(struct __sk_buff *skb)
+{
+    return report(skb, PROG_SOCKET, 0, 1);
+}
+
+SEC("classifier")
+int report_ingress_perf(struct __sk_buff *skb)
+{
+    return report(skb, PROG_TC, INGRESS, 1);
+}
+
+SEC("classifier")
+int report_egress_perf(struct __sk_buff *skb)
+{
+    return report(skb, PROG_TC, EGRESS, 1);
+}
+
+// XDP programs only observe, every frame is passed on to the stack.
+SEC("xdp")
+int report_xdp(struct xdp_md *ctx)
+{
+    report(ctx, PROG_XDP, INGRESS, 0);
+    return XDP_PASS;
+}
+
+SEC("xdp")
+int report_xdp_perf(struct xdp_md *ctx)
+{
+    report(ctx, PROG_XDP, INGRESS, 1);
+    return XDP_PASS;
+}
+
 char _license[] SEC("license") = "GPL";
@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/cilium/ebpf v0.8.1
+	github.com/google/gopacket v1.1.19
 	github.com/prometheus/procfs v0.7.3
 	github.com/spf13/cobra v1.4.0
 	github.com/spf13/jwalterweatherman v1.1.0
@@ -12,7 +13,6 @@ require (
 )
 
 require (
-	github.com/google/gopacket v1.1.19 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
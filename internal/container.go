@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"time"
+
+	"ogomon/pkg"
+
+	"github.com/prometheus/procfs"
+)
+
+// Every tick scans the cgroups of all processes to find the container's.
+const CONTAINER_TICKER_TIME = 500 * time.Millisecond
+
+// NewContainerTracer records a whole container, its processes under procRoot
+// summed together: the number of processes and threads, resident memory in
+// bytes, user and system time in ticks, minor and major faults and bytes read
+// and written. Counters of processes that exited keep their last value.
+func NewContainerTracer(proc *procfs.Proc, procRoot string, containerID string, appendFile bool) (*SystemTracer, error) {
+	if _, err := pkg.GetContainerProcs(procRoot, containerID); err != nil {
+		return nil, err
+	}
+	logFile, err := pkg.OpenRecordFile("records/container", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newContainerTicker(procRoot, containerID), writer: writer, tickerTime: CONTAINER_TICKER_TIME}, nil
+}
+
+func newContainerTicker(procRoot string, containerID string) DataTicker {
+	totals := newThreadTotals(6)
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		procs, _ := pkg.GetContainerProcs(procRoot, containerID)
+		current := make(map[int][]uint64, len(procs))
+		var threads, rss uint64
+		for _, p := range procs {
+			stat, err := p.Stat()
+			if err != nil {
+				continue
+			}
+			// Without CAP_SYS_PTRACE the io of other users' processes is unreadable.
+			io, _ := p.IO()
+			current[p.PID] = []uint64{uint64(stat.UTime), uint64(stat.STime), uint64(stat.MinFlt), uint64(stat.MajFlt), io.ReadBytes, io.WriteBytes}
+			threads += uint64(stat.NumThreads)
+			rss += uint64(stat.ResidentMemory())
+		}
+		sums := totals.update(current)
+		logData := fmt.Sprintf(
+			"%d,%d,%d,%d,%d,%d,%d,%d,%d,%d\n",
+			evTime, len(current), threads, rss,
+			sums[0], sums[1], sums[2], sums[3], sums[4], sums[5],
+		)
+		tracer.writer.WriteString(logData)
+		return evTime
+	}
+}
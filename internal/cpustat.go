@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"ogomon/pkg"
+
+	"github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// /proc/stat counts in USER_HZ, rates over shorter intervals are mostly noise.
+	CPU_TICKER_TIME = 100 * time.Millisecond
+)
+
+// softirqNames are the /proc/softirqs rows recorded, in output column order.
+var softirqNames = []string{"HI", "TIMER", "NET_TX", "NET_RX", "BLOCK", "IRQ_POLL", "TASKLET", "SCHED", "HRTIMER", "RCU"}
+
+// allowedCPUs returns a predicate telling whether cpu is in the affinity mask of
+// pid. Every cpu is reported as allowed when the mask cannot be read.
+func allowedCPUs(pid int) func(cpu int) bool {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(pid, &set); err != nil {
+		return func(cpu int) bool { return true }
+	}
+	return set.IsSet
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// readSoftirqs returns the /proc/softirqs counters by name, one per cpu.
+func readSoftirqs() (map[string][]uint64, error) {
+	f, err := os.Open(filepath.Join(procfs.DefaultMountPoint, "softirqs"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	counters := make(map[string][]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasSuffix(fields[0], ":") {
+			continue
+		}
+		values := make([]uint64, 0, len(fields)-1)
+		for _, field := range fields[1:] {
+			v, _ := strconv.ParseUint(field, 10, 64)
+			values = append(values, v)
+		}
+		counters[strings.TrimSuffix(fields[0], ":")] = values
+	}
+	return counters, scanner.Err()
+}
+
+// NewCPUTracer records the utilization of every cpu of the host as the share of
+// each interval spent in user, nice, system, idle, iowait, irq, softirq and
+// steal, one line per cpu and tick. The third column tells whether the target
+// may run on that cpu.
+func NewCPUTracer(fs *procfs.FS, proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/cpu", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 16384)
+	return &SystemTracer{fs: fs, proc: proc, logFile: logFile, ticker: newCPUTicker(), writer: writer, tickerTime: CPU_TICKER_TIME}, nil
+}
+
+// NewSoftirqTracer records per cpu softirq rates, in events per second, for
+// every softirq type. The third column tells whether the target may run on
+// that cpu.
+func NewSoftirqTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/softirqs", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 16384)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newSoftirqTicker(), writer: writer, tickerTime: CPU_TICKER_TIME}, nil
+}
+
+func newCPUTicker() DataTicker {
+	var prev []procfs.CPUStat
+	var prevTime uint64
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		stat, err := tracer.fs.Stat()
+		if err != nil {
+			return evTime
+		}
+		allowed := allowedCPUs(tracer.proc.PID)
+		elapsed := float64(evTime-prevTime) / float64(time.Second)
+		if prev != nil && elapsed > 0 {
+			for cpu := range stat.CPU {
+				if cpu >= len(prev) {
+					break
+				}
+				cur, old := stat.CPU[cpu], prev[cpu]
+				logData := fmt.Sprintf(
+					"%d,%d,%d,%.3f,%.3f,%.3f,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+					evTime, cpu, boolToInt(allowed(cpu)),
+					(cur.User-old.User)/elapsed, (cur.Nice-old.Nice)/elapsed,
+					(cur.System-old.System)/elapsed, (cur.Idle-old.Idle)/elapsed,
+					(cur.Iowait-old.Iowait)/elapsed, (cur.IRQ-old.IRQ)/elapsed,
+					(cur.SoftIRQ-old.SoftIRQ)/elapsed, (cur.Steal-old.Steal)/elapsed,
+				)
+				tracer.writer.WriteString(logData)
+			}
+		}
+		prev, prevTime = stat.CPU, evTime
+		return evTime
+	}
+}
+
+func newSoftirqTicker() DataTicker {
+	var prev map[string][]uint64
+	var prevTime uint64
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		counters, err := readSoftirqs()
+		if err != nil {
+			return evTime
+		}
+		allowed := allowedCPUs(tracer.proc.PID)
+		elapsed := float64(evTime-prevTime) / float64(time.Second)
+		if prev != nil && elapsed > 0 {
+			cpus := len(counters[softirqNames[0]])
+			for cpu := 0; cpu < cpus; cpu++ {
+				var logData strings.Builder
+				fmt.Fprintf(&logData, "%d,%d,%d", evTime, cpu, boolToInt(allowed(cpu)))
+				for _, name := range softirqNames {
+					var rate float64
+					if cur, old := counters[name], prev[name]; cpu < len(cur) && cpu < len(old) {
+						rate = float64(cur[cpu]-old[cpu]) / elapsed
+					}
+					fmt.Fprintf(&logData, ",%.1f", rate)
+				}
+				logData.WriteByte('\n')
+				tracer.writer.WriteString(logData.String())
+			}
+		}
+		prev, prevTime = counters, evTime
+		return evTime
+	}
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"ogomon/pkg"
+
+	"github.com/prometheus/procfs"
+	"github.com/prometheus/procfs/blockdevice"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DISKSTATS_TICKER_TIME = 10 * time.Millisecond
+)
+
+// deviceNumber returns the "major:minor" of the block device holding path.
+// Filesystems without a block device of their own, like btrfs subvolumes,
+// report an anonymous device and are resolved through the mount source.
+func deviceNumber(path string, mounts []*procfs.MountInfo) (string, bool) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", false
+	}
+	dev := fmt.Sprintf("%d:%d", unix.Major(st.Dev), unix.Minor(st.Dev))
+	if unix.Major(st.Dev) != 0 {
+		return dev, true
+	}
+	for _, mount := range mounts {
+		if mount.MajorMinorVer != dev || !strings.HasPrefix(mount.Source, "/dev/") {
+			continue
+		}
+		var source unix.Stat_t
+		if err := unix.Stat(mount.Source, &source); err == nil && source.Mode&unix.S_IFMT == unix.S_IFBLK {
+			return fmt.Sprintf("%d:%d", unix.Major(source.Rdev), unix.Minor(source.Rdev)), true
+		}
+	}
+	return "", false
+}
+
+// parentDevice returns the whole disk a partition belongs to, since that is
+// where saturation shows.
+func parentDevice(dev string) (string, bool) {
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/dev/block", dev))
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(filepath.Join(sysPath, "partition")); err != nil {
+		return "", false
+	}
+	parent, err := os.ReadFile(filepath.Join(filepath.Dir(sysPath), "dev"))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(parent)), true
+}
+
+// procBlockDevices returns the block devices backing the working directory and
+// the open files of proc, as "major:minor" numbers.
+func procBlockDevices(proc *procfs.Proc) map[string]bool {
+	paths := []string{}
+	if cwd, err := proc.Cwd(); err == nil {
+		paths = append(paths, cwd)
+	}
+	targets, _ := proc.FileDescriptorTargets()
+	for _, target := range targets {
+		if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "/dev/") &&
+			!strings.HasPrefix(target, "/proc/") && !strings.HasPrefix(target, "/sys/") {
+			paths = append(paths, target)
+		}
+	}
+	mounts, _ := proc.MountInfo()
+	devices := make(map[string]bool)
+	for _, path := range paths {
+		// Resolve through the target's root so paths inside containers point at the right file.
+		dev, ok := deviceNumber(filepath.Join(procfs.DefaultMountPoint, strconv.Itoa(proc.PID), "root", path), mounts)
+		if !ok {
+			continue
+		}
+		devices[dev] = true
+		if parent, ok := parentDevice(dev); ok {
+			devices[parent] = true
+		}
+	}
+	return devices
+}
+
+// NewDiskStatsTracer records /proc/diskstats for deviceNames, or when none are
+// given for the devices backing the target's working directory and the files
+// it has open when the tracer is created.
+func NewDiskStatsTracer(proc *procfs.Proc, deviceNames []string, appendFile bool) (*SystemTracer, error) {
+	fs, err := blockdevice.NewDefaultFS()
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := pkg.OpenRecordFile("records/diskstats", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	var selected func(stats blockdevice.Diskstats) bool
+	if len(deviceNames) > 0 {
+		names := make(map[string]bool)
+		for _, name := range deviceNames {
+			names[strings.TrimPrefix(name, "/dev/")] = true
+		}
+		selected = func(stats blockdevice.Diskstats) bool { return names[stats.DeviceName] }
+	} else {
+		devices := procBlockDevices(proc)
+		selected = func(stats blockdevice.Diskstats) bool {
+			return devices[fmt.Sprintf("%d:%d", stats.MajorNumber, stats.MinorNumber)]
+		}
+	}
+	writer := bufio.NewWriterSize(logFile, 16384)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newDiskStatsTicker(fs, selected), writer: writer, tickerTime: DISKSTATS_TICKER_TIME}, nil
+}
+
+func newDiskStatsTicker(fs blockdevice.FS, selected func(blockdevice.Diskstats) bool) DataTicker {
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		diskstats, _ := fs.ProcDiskstats()
+		for _, stats := range diskstats {
+			if !selected(stats) {
+				continue
+			}
+			logData := fmt.Sprintf(
+				"%d,%s,%d,%d,%d,%d,%d,%d,%d,%d,%d\n",
+				evTime, stats.DeviceName,
+				stats.ReadIOs, stats.ReadSectors, stats.ReadTicks,
+				stats.WriteIOs, stats.WriteSectors, stats.WriteTicks,
+				stats.IOsInProgress, stats.IOsTotalTicks, stats.WeightedIOTicks,
+			)
+			tracer.writer.WriteString(logData)
+		}
+		return evTime
+	}
+}
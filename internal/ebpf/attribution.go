@@ -0,0 +1,139 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
+	"ogomon/pkg"
+)
+
+// Mirrors of the filter_config attribution modes in tc_acl.c.
+const (
+	ATTRIBUTE_NONE = iota
+	ATTRIBUTE_SOCKET
+	ATTRIBUTE_CGROUP
+)
+
+// Sockets opened since the last scan are missed until the next one, and their
+// flows until the target sends on them.
+const TARGET_TICKER_TIME = 250 * time.Millisecond
+
+var attributionModes = map[string]uint32{
+	"none":   ATTRIBUTE_NONE,
+	"socket": ATTRIBUTE_SOCKET,
+	"cgroup": ATTRIBUTE_CGROUP,
+}
+
+// Attribution keeps only the packets of process Pid, told by the cookies of
+// its sockets or by its cgroup. Only egress packets carry their socket, so
+// ingress packets are attributed by the flows of the target. It needs the tc
+// programs, the copies socket filters see belong to no socket.
+type Attribution struct {
+	Mode     uint32
+	Pid      int
+	CgroupID uint64
+}
+
+// NewAttribution returns the attribution of mode, none, socket or cgroup, to
+// proc.
+func NewAttribution(mode string, proc procfs.Proc) (Attribution, error) {
+	attributionMode, ok := attributionModes[mode]
+	if !ok {
+		return Attribution{}, fmt.Errorf("unknown attribution %q", mode)
+	}
+	attribution := Attribution{Mode: attributionMode, Pid: proc.PID}
+	if attributionMode == ATTRIBUTE_CGROUP {
+		cgroupID, err := pkg.CgroupV2ID(proc)
+		if err != nil {
+			return Attribution{}, err
+		}
+		attribution.CgroupID = cgroupID
+	}
+	return attribution, nil
+}
+
+// targetSockets keeps target_sockets and target_flows in step with the sockets
+// of the target.
+type targetSockets struct {
+	pid     int
+	diag    *pkg.SockDiag
+	cookies map[uint64]bool
+}
+
+// newTargetSockets lists the sockets of the network namespace of the calling
+// thread, which must be the target's.
+func newTargetSockets(pid int) (*targetSockets, error) {
+	diag, err := pkg.NewSockDiag()
+	if err != nil {
+		return nil, err
+	}
+	return &targetSockets{pid: pid, diag: diag, cookies: make(map[uint64]bool)}, nil
+}
+
+// sync adds the cookies and flows of the target's sockets and removes the
+// cookies of the sockets it closed. Flows are left to age out of the LRU map.
+func (target *targetSockets) sync(objs *networkObjects) error {
+	proc, err := procfs.NewProc(target.pid)
+	if err != nil {
+		return err
+	}
+	inodes := pkg.SocketInodes(&proc)
+	cookies := make(map[uint64]bool)
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		for _, protocol := range []uint8{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+			sockets, err := target.diag.Sockets(family, protocol)
+			if errors.Is(err, unix.ENOENT) {
+				// udp_diag is not loaded.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, socket := range sockets {
+				if !inodes[socket.Inode] {
+					continue
+				}
+				cookies[socket.Cookie] = true
+				if err := objs.TargetSockets.Put(socket.Cookie, uint8(1)); err != nil {
+					return err
+				}
+				if socket.Dport == 0 {
+					continue
+				}
+				if err := objs.TargetFlows.Put(ingressFlowKey(socket), uint8(1)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for cookie := range target.cookies {
+		if !cookies[cookie] {
+			objs.TargetSockets.Delete(cookie)
+		}
+	}
+	target.cookies = cookies
+	return nil
+}
+
+// ingressFlowKey returns the target_flows key of the packets socket receives.
+// IPv4 peers of IPv6 sockets send IPv4 packets.
+func ingressFlowKey(socket pkg.InetSocket) tcACLFlowKey {
+	key := tcACLFlowKey{Sport: socket.Dport, Dport: socket.Sport, Protocol: socket.Protocol}
+	if src, dst := socket.Src.To4(), socket.Dst.To4(); src != nil && dst != nil {
+		key.Family = unix.AF_INET
+		copy(key.Saddr[:], dst)
+		copy(key.Daddr[:], src)
+	} else {
+		key.Family = unix.AF_INET6
+		copy(key.Saddr[:], socket.Dst.To16())
+		copy(key.Daddr[:], socket.Src.To16())
+	}
+	return key
+}
+
+func (target *targetSockets) Close() error {
+	return target.diag.Close()
+}
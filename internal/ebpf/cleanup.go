@@ -0,0 +1,70 @@
+package ebpf
+
+import (
+	"github.com/cilium/ebpf"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/vishvananda/netlink"
+)
+
+// Names the kernel keeps for ogomon's XDP programs.
+var xdpProgramNames = map[string]bool{
+	"report_xdp":      true,
+	"report_xdp_perf": true,
+}
+
+// CleanupDevice removes the tc filters and the XDP program ogomon left on
+// deviceName, in the calling thread's network namespace, and returns how many
+// it removed. Other filters and programs, and the clsact qdisc, which ogomon
+// cannot tell it created, stay.
+func CleanupDevice(deviceName string) (int, error) {
+	handle, err := netlink.NewHandle()
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Delete()
+	link, err := handle.LinkByName(deviceName)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filters, err := handle.FilterList(link, parent)
+		if err != nil {
+			return removed, err
+		}
+		for _, filter := range filters {
+			bpfFilter, ok := filter.(*netlink.BpfFilter)
+			if !ok || (bpfFilter.Name != TC_FILTER_INGRESS && bpfFilter.Name != TC_FILTER_EGRESS) {
+				continue
+			}
+			if err := handle.FilterDel(filter); err != nil {
+				return removed, err
+			}
+			jww.INFO.Printf("Removed tc filter %s from %s", bpfFilter.Name, deviceName)
+			removed++
+		}
+	}
+
+	xdp := link.Attrs().Xdp
+	if xdp == nil || !xdp.Attached {
+		return removed, nil
+	}
+	program, err := ebpf.NewProgramFromID(ebpf.ProgramID(xdp.ProgId))
+	if err != nil {
+		return removed, err
+	}
+	info, err := program.Info()
+	program.Close()
+	if err != nil {
+		return removed, err
+	}
+	if !xdpProgramNames[info.Name] {
+		return removed, nil
+	}
+	if err := detachXdpAnyMode(link, xdp.ProgId); err != nil {
+		return removed, err
+	}
+	jww.INFO.Printf("Removed XDP program %s from %s", info.Name, deviceName)
+	return removed + 1, nil
+}
@@ -0,0 +1,346 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// Mirrors of the filter definitions in tc_acl.c.
+const (
+	FILTER_PORTS = 1 << iota
+	FILTER_NETS
+	FILTER_PROTOCOLS
+	FILTER_DIRECTIONS
+)
+
+const (
+	SIDE_SRC uint32 = 1 << iota
+	SIDE_DST
+	SIDE_ANY = SIDE_SRC | SIDE_DST
+)
+
+// Direction values of events.
+const (
+	EVENT_INGRESS = 1
+	EVENT_EGRESS  = 2
+)
+
+const MAX_PORT_RANGES = 16
+
+type filterConfig struct {
+	Flags       uint32
+	Directions  uint32
+	PortRanges  uint32
+	Attribution uint32
+	CgroupID    uint64
+}
+
+type portRange struct {
+	From  uint16
+	To    uint16
+	Sides uint32
+}
+
+type netKey struct {
+	Prefixlen uint32
+	Family    uint8
+	Addr      [16]uint8
+	Pad       [3]uint8
+}
+
+// PortMatch matches ports From to To, inclusive, on the Side ends of a flow.
+type PortMatch struct {
+	From uint16
+	To   uint16
+	Side uint32
+}
+
+// NetMatch matches addresses in Net on the Side ends of a flow.
+type NetMatch struct {
+	Net  *net.IPNet
+	Side uint32
+}
+
+// Filter selects the packets reported. Every non empty field must match,
+// within a field any entry may. Packets without ports, like ICMP, never match
+// a port filter.
+type Filter struct {
+	Ports       []PortMatch
+	Nets        []NetMatch
+	Protocols   []uint8
+	Directions  []uint64
+	Attribution Attribution
+}
+
+var protocolNames = map[string]uint8{
+	"tcp":     unix.IPPROTO_TCP,
+	"udp":     unix.IPPROTO_UDP,
+	"udplite": unix.IPPROTO_UDPLITE,
+	"icmp":    unix.IPPROTO_ICMP,
+	"icmp6":   unix.IPPROTO_ICMPV6,
+}
+
+var directionNames = map[string]uint64{
+	"ingress": EVENT_INGRESS,
+	"egress":  EVENT_EGRESS,
+}
+
+// ParseFilter parses space separated key=value terms, where value may be a
+// comma separated list:
+//
+//	port=80,8000-8080   source or destination port or port range
+//	sport=, dport=      source or destination port only
+//	net=10.0.0.0/8      source or destination address or network
+//	src=, dst=          source or destination address only
+//	proto=tcp,udp       tcp, udp, udplite, icmp, icmp6 or a protocol number
+//	dir=ingress         ingress or egress
+//
+// Fragments past the first have no ports and only pass filters without port
+// terms.
+func ParseFilter(expr string) (Filter, error) {
+	var filter Filter
+	for _, term := range strings.Fields(expr) {
+		key, values, ok := strings.Cut(term, "=")
+		if !ok || values == "" {
+			return Filter{}, fmt.Errorf("filter term %q is not key=value", term)
+		}
+		for _, value := range strings.Split(values, ",") {
+			var err error
+			switch key {
+			case "port":
+				err = filter.addPort(value, SIDE_ANY)
+			case "sport":
+				err = filter.addPort(value, SIDE_SRC)
+			case "dport":
+				err = filter.addPort(value, SIDE_DST)
+			case "net":
+				err = filter.addNet(value, SIDE_ANY)
+			case "src":
+				err = filter.addNet(value, SIDE_SRC)
+			case "dst":
+				err = filter.addNet(value, SIDE_DST)
+			case "proto":
+				err = filter.addProtocol(value)
+			case "dir":
+				direction, ok := directionNames[value]
+				if !ok {
+					err = fmt.Errorf("unknown direction %q", value)
+				}
+				filter.Directions = append(filter.Directions, direction)
+			default:
+				err = fmt.Errorf("unknown filter key %q", key)
+			}
+			if err != nil {
+				return Filter{}, err
+			}
+		}
+	}
+	return filter, nil
+}
+
+func (filter *Filter) addPort(value string, side uint32) error {
+	from, to, isRange := strings.Cut(value, "-")
+	if !isRange {
+		to = from
+	}
+	fromPort, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", value)
+	}
+	toPort, err := strconv.ParseUint(to, 10, 16)
+	if err != nil || toPort < fromPort {
+		return fmt.Errorf("invalid port range %q", value)
+	}
+	filter.Ports = append(filter.Ports, PortMatch{From: uint16(fromPort), To: uint16(toPort), Side: side})
+	return nil
+}
+
+func (filter *Filter) addNet(value string, side uint32) error {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid address %q", value)
+		}
+		if ip.To4() != nil {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	filter.Nets = append(filter.Nets, NetMatch{Net: ipNet, Side: side})
+	return nil
+}
+
+func (filter *Filter) addProtocol(value string) error {
+	if proto, ok := protocolNames[value]; ok {
+		filter.Protocols = append(filter.Protocols, proto)
+		return nil
+	}
+	proto, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return fmt.Errorf("unknown protocol %q", value)
+	}
+	filter.Protocols = append(filter.Protocols, uint8(proto))
+	return nil
+}
+
+// AddDirection matches packets going in direction.
+func (filter *Filter) AddDirection(direction Direction) {
+	if direction == INGRESS {
+		filter.Directions = append(filter.Directions, EVENT_INGRESS)
+	} else {
+		filter.Directions = append(filter.Directions, EVENT_EGRESS)
+	}
+}
+
+// AddPort matches port on the side ends of a flow.
+func (filter *Filter) AddPort(port uint16, side uint32) {
+	filter.Ports = append(filter.Ports, PortMatch{From: port, To: port, Side: side})
+}
+
+func newNetKey(ipNet *net.IPNet) netKey {
+	ones, _ := ipNet.Mask.Size()
+	key := netKey{Prefixlen: 8 + uint32(ones)}
+	if ip := ipNet.IP.To4(); ip != nil {
+		key.Family = unix.AF_INET
+		copy(key.Addr[:], ip)
+	} else {
+		key.Family = unix.AF_INET6
+		copy(key.Addr[:], ipNet.IP.To16())
+	}
+	return key
+}
+
+// netSides returns the sides every network matches on. The kernel only returns
+// the longest matching prefix, so each network also carries the sides of the
+// networks containing it.
+func netSides(nets []NetMatch) map[netKey]uint32 {
+	sides := make(map[netKey]uint32)
+	for _, n := range nets {
+		ones, bits := n.Net.Mask.Size()
+		side := uint32(0)
+		for _, outer := range nets {
+			outerOnes, outerBits := outer.Net.Mask.Size()
+			if outerBits == bits && outerOnes <= ones && outer.Net.Contains(n.Net.IP) {
+				side |= outer.Side
+			}
+		}
+		sides[newNetKey(n.Net)] |= side
+	}
+	return sides
+}
+
+// loadFilter writes filter into the maps read by the program, without
+// detaching it. New entries are added before filter_config enables them and
+// stale ones removed after, so the program sees a mix of both filters only
+// while the maps are written.
+func loadFilter(objs *networkObjects, filter Filter) error {
+	ports := make(map[uint16]uint32)
+	var ranges []portRange
+	for _, p := range filter.Ports {
+		if p.From == p.To {
+			ports[p.From] |= p.Side
+		} else {
+			ranges = append(ranges, portRange{From: p.From, To: p.To, Sides: p.Side})
+		}
+	}
+	if len(ranges) > MAX_PORT_RANGES {
+		return fmt.Errorf("at most %d port ranges are supported", MAX_PORT_RANGES)
+	}
+	nets := netSides(filter.Nets)
+
+	for port, side := range ports {
+		if err := objs.FilterPorts.Put(port, side); err != nil {
+			return err
+		}
+	}
+	for idx, r := range ranges {
+		if err := objs.FilterPortRanges.Put(uint32(idx), r); err != nil {
+			return err
+		}
+	}
+	for key, side := range nets {
+		if err := objs.FilterNets.Put(key, side); err != nil {
+			return err
+		}
+	}
+	protocols := make([]uint8, 256)
+	for _, proto := range filter.Protocols {
+		protocols[proto] = 1
+	}
+	for proto, allowed := range protocols {
+		if err := objs.FilterProtocols.Put(uint32(proto), allowed); err != nil {
+			return err
+		}
+	}
+
+	config := filterConfig{
+		PortRanges:  uint32(len(ranges)),
+		Attribution: filter.Attribution.Mode,
+		CgroupID:    filter.Attribution.CgroupID,
+	}
+	for _, direction := range filter.Directions {
+		config.Directions |= 1 << direction
+	}
+	if len(filter.Ports) > 0 {
+		config.Flags |= FILTER_PORTS
+	}
+	if len(filter.Nets) > 0 {
+		config.Flags |= FILTER_NETS
+	}
+	if len(filter.Protocols) > 0 {
+		config.Flags |= FILTER_PROTOCOLS
+	}
+	if len(filter.Directions) > 0 {
+		config.Flags |= FILTER_DIRECTIONS
+	}
+	if err := objs.FilterConfig.Put(uint32(0), config); err != nil {
+		return err
+	}
+
+	var stalePorts []uint16
+	var port uint16
+	var side uint32
+	iter := objs.FilterPorts.Iterate()
+	for iter.Next(&port, &side) {
+		if _, ok := ports[port]; !ok {
+			stalePorts = append(stalePorts, port)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, port := range stalePorts {
+		if err := objs.FilterPorts.Delete(port); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+
+	var staleNets []netKey
+	var key netKey
+	iter = objs.FilterNets.Iterate()
+	for iter.Next(&key, &side) {
+		if _, ok := nets[key]; !ok {
+			staleNets = append(staleNets, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range staleNets {
+		if err := objs.FilterNets.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package ebpf
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipNet
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr  string
+		ports []PortMatch
+		nets  []string
+		sides []uint32
+		proto []uint8
+		dirs  []uint64
+	}{
+		{expr: ""},
+		{
+			expr:  "port=80,8000-8080 sport=53 dport=443",
+			ports: []PortMatch{{80, 80, SIDE_ANY}, {8000, 8080, SIDE_ANY}, {53, 53, SIDE_SRC}, {443, 443, SIDE_DST}},
+		},
+		{
+			expr:  "net=10.0.0.0/8 src=192.168.1.7 dst=fd00::/64,::1",
+			nets:  []string{"10.0.0.0/8", "192.168.1.7/32", "fd00::/64", "::1/128"},
+			sides: []uint32{SIDE_ANY, SIDE_SRC, SIDE_DST, SIDE_DST},
+		},
+		{
+			expr:  "proto=tcp,udp,icmp6,132",
+			proto: []uint8{unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_ICMPV6, 132},
+		},
+		{
+			expr: "dir=egress  \n dir=ingress",
+			dirs: []uint64{EVENT_EGRESS, EVENT_INGRESS},
+		},
+	}
+	for _, test := range tests {
+		filter, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", test.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(filter.Ports, test.ports) {
+			t.Errorf("ParseFilter(%q) ports %v, want %v", test.expr, filter.Ports, test.ports)
+		}
+		var nets []string
+		var sides []uint32
+		for _, n := range filter.Nets {
+			nets = append(nets, n.Net.String())
+			sides = append(sides, n.Side)
+		}
+		if !reflect.DeepEqual(nets, test.nets) || !reflect.DeepEqual(sides, test.sides) {
+			t.Errorf("ParseFilter(%q) nets %v %v, want %v %v", test.expr, nets, sides, test.nets, test.sides)
+		}
+		if !reflect.DeepEqual(filter.Protocols, test.proto) {
+			t.Errorf("ParseFilter(%q) protocols %v, want %v", test.expr, filter.Protocols, test.proto)
+		}
+		if !reflect.DeepEqual(filter.Directions, test.dirs) {
+			t.Errorf("ParseFilter(%q) directions %v, want %v", test.expr, filter.Directions, test.dirs)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"port",
+		"port=",
+		"port=http",
+		"port=70000",
+		"port=90-80",
+		"net=10.0.0.0/33",
+		"src=example.com",
+		"proto=sctp",
+		"proto=256",
+		"dir=both",
+		"host=10.0.0.1",
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestNetSides(t *testing.T) {
+	tests := []struct {
+		name string
+		nets []NetMatch
+		want map[string]uint32
+	}{
+		{
+			name: "disjoint",
+			nets: []NetMatch{{mustCIDR(t, "10.0.0.0/8"), SIDE_SRC}, {mustCIDR(t, "192.168.0.0/16"), SIDE_DST}},
+			want: map[string]uint32{"10.0.0.0/8": SIDE_SRC, "192.168.0.0/16": SIDE_DST},
+		},
+		{
+			name: "nested inherits the outer sides",
+			nets: []NetMatch{{mustCIDR(t, "10.1.0.0/16"), SIDE_DST}, {mustCIDR(t, "10.0.0.0/8"), SIDE_SRC}},
+			want: map[string]uint32{"10.0.0.0/8": SIDE_SRC, "10.1.0.0/16": SIDE_ANY},
+		},
+		{
+			name: "duplicates merge",
+			nets: []NetMatch{{mustCIDR(t, "10.0.0.0/8"), SIDE_SRC}, {mustCIDR(t, "10.0.0.0/8"), SIDE_DST}},
+			want: map[string]uint32{"10.0.0.0/8": SIDE_ANY},
+		},
+		{
+			name: "families do not nest",
+			nets: []NetMatch{{mustCIDR(t, "::/0"), SIDE_SRC}, {mustCIDR(t, "10.0.0.0/8"), SIDE_DST}},
+			want: map[string]uint32{"::/0": SIDE_SRC, "10.0.0.0/8": SIDE_DST},
+		},
+	}
+	for _, test := range tests {
+		want := make(map[netKey]uint32)
+		for cidr, side := range test.want {
+			want[newNetKey(mustCIDR(t, cidr))] = side
+		}
+		if got := netSides(test.nets); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: netSides = %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestNewNetKey(t *testing.T) {
+	key := newNetKey(mustCIDR(t, "10.1.0.0/16"))
+	if key.Family != unix.AF_INET || key.Prefixlen != 8+16 || key.Addr != [16]uint8{10, 1} {
+		t.Errorf("newNetKey(10.1.0.0/16) = %+v", key)
+	}
+	key = newNetKey(mustCIDR(t, "fd00::/64"))
+	if key.Family != unix.AF_INET6 || key.Prefixlen != 8+64 || key.Addr != [16]uint8{0xfd} {
+		t.Errorf("newNetKey(fd00::/64) = %+v", key)
+	}
+}
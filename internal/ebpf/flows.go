@@ -0,0 +1,120 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/sys/unix"
+	"ogomon/pkg"
+)
+
+// Mirrors of the report_config flags in tc_acl.c.
+const (
+	REPORT_EVENTS = 1 << iota
+	REPORT_FLOWS
+)
+
+const (
+	FLOW_TICKER_TIME = time.Second
+	FLOW_BATCH_SIZE  = 4096
+)
+
+// Mirrors of the lost_events entries in tc_acl.c.
+const (
+	LOST_EVENTS = iota
+	LOST_FLOWS
+)
+
+// loadReportConfig tells the program to aggregate flows, and to emit per
+// packet events when packetEvents is set.
+func loadReportConfig(objs *networkObjects, packetEvents bool) error {
+	flags := uint32(REPORT_FLOWS)
+	if packetEvents {
+		flags |= REPORT_EVENTS
+	}
+	return objs.ReportConfig.Put(uint32(0), flags)
+}
+
+// formatFlow writes the flow record of one interval: its end, the flow's
+// addresses, ports, protocol and direction, packets, bytes, first and last
+// packet time and the log2 packet size histogram.
+func formatFlow(ts uint64, key tcACLFlowKey, stats tcACLFlowStats, wallOffset uint64) string {
+	var saddr, daddr net.IP
+	if key.Family == unix.AF_INET {
+		saddr, daddr = net.IP(key.Saddr[:net.IPv4len]), net.IP(key.Daddr[:net.IPv4len])
+	} else {
+		saddr, daddr = net.IP(key.Saddr[:]), net.IP(key.Daddr[:])
+	}
+	var logData strings.Builder
+	fmt.Fprintf(
+		&logData, "%d,%s,%s,%d,%d,%d,%d,%d,%d,%d,%d",
+		ts, saddr, daddr, key.Sport, key.Dport, key.Protocol, key.Direction,
+		stats.Packets, stats.Bytes, stats.FirstSeen+wallOffset, stats.LastSeen+wallOffset,
+	)
+	for _, count := range stats.Sizes {
+		logData.WriteByte(',')
+		logData.WriteString(strconv.FormatUint(count, 10))
+	}
+	logData.WriteByte('\n')
+	return logData.String()
+}
+
+// writeFlows reads and removes every flow counted since the last call, so
+// each record covers one interval. Packets counted while a batch is removed
+// are lost. Kernels before 5.6 have no batch operations, the map is walked
+// instead.
+func (tracer NetworkTracer) writeFlows() {
+	keys := make([]tcACLFlowKey, FLOW_BATCH_SIZE)
+	values := make([]tcACLFlowStats, FLOW_BATCH_SIZE)
+	ts := uint64(time.Now().UnixNano())
+	wallOffset := ts - pkg.GetMonoTime()
+	var cursor tcACLFlowKey
+	var prevKey interface{}
+	for {
+		count, err := tracer.getEbpfObjects().Flows.BatchLookupAndDelete(prevKey, &cursor, keys, values, nil)
+		for idx := 0; idx < count; idx++ {
+			tracer.flowWriter.WriteString(formatFlow(ts, keys[idx], values[idx], wallOffset))
+		}
+		if errors.Is(err, ebpf.ErrNotSupported) && prevKey == nil {
+			tracer.writeFlowsIterating(ts, wallOffset)
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, ebpf.ErrKeyNotExist) {
+				jww.ERROR.Println(err)
+			}
+			break
+		}
+		prevKey = &cursor
+	}
+	tracer.flowWriter.Flush()
+}
+
+// writeFlowsIterating reads every flow, then deletes the ones it read. Packets
+// counted in between are lost like with batches, only over a longer window.
+func (tracer NetworkTracer) writeFlowsIterating(ts uint64, wallOffset uint64) {
+	flows := tracer.getEbpfObjects().Flows
+	var key tcACLFlowKey
+	var stats tcACLFlowStats
+	var keys []tcACLFlowKey
+	iter := flows.Iterate()
+	for iter.Next(&key, &stats) {
+		tracer.flowWriter.WriteString(formatFlow(ts, key, stats, wallOffset))
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		jww.ERROR.Println(err)
+	}
+	for idx := range keys {
+		if err := flows.Delete(&keys[idx]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			jww.ERROR.Println(err)
+			return
+		}
+	}
+}
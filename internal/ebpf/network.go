@@ -1,75 +1,302 @@
 package ebpf
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"sort"
+	"sync/atomic"
 	"time"
-	"bufio"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/ringbuf"
 	"github.com/cilium/ebpf/rlimit"
 	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/sys/unix"
+	"ogomon/pkg"
 )
 
 const (
-	NET_STAT_STEP        = 50
-	NET_STAT_TICKER_TIME = time.Microsecond * NET_STAT_STEP
+	NET_STAT_TICKER_TIME = 10 * time.Millisecond
+	// Events from different cpus reach the reader out of order, they are held
+	// back this long before being written sorted by time.
+	EVENT_REORDER_WINDOW = 10 * time.Millisecond
+	EVENT_CHANNEL_SIZE   = 4096
+	PERF_BUFFER_SIZE     = 1 << 20
 )
 
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go@main -type event -type flow_key -type flow_stats tcACL ../../ebpf/tc_acl.c -- -I../../ebpf/include -nostdinc -O3
+
+// networkObjects are the parts of tcACLObjects delivering events one way,
+// kernels without ring buffers cannot load the others.
+type networkObjects struct {
+	ReportPacketSize *ebpf.Program `ebpf:"report_packet_size"`
+	ReportIngress    *ebpf.Program `ebpf:"report_ingress"`
+	ReportEgress     *ebpf.Program `ebpf:"report_egress"`
+	ReportXdp        *ebpf.Program `ebpf:"report_xdp"`
+	Events           *ebpf.Map     `ebpf:"events"`
+	Flows            *ebpf.Map     `ebpf:"flows"`
+	ReportConfig     *ebpf.Map     `ebpf:"report_config"`
+	LostEvents       *ebpf.Map     `ebpf:"lost_events"`
+	FilterConfig     *ebpf.Map     `ebpf:"filter_config"`
+	FilterPorts      *ebpf.Map     `ebpf:"filter_ports"`
+	FilterPortRanges *ebpf.Map     `ebpf:"filter_port_ranges"`
+	FilterNets       *ebpf.Map     `ebpf:"filter_nets"`
+	FilterProtocols  *ebpf.Map     `ebpf:"filter_protocols"`
+	TargetSockets    *ebpf.Map     `ebpf:"target_sockets"`
+	TargetFlows      *ebpf.Map     `ebpf:"target_flows"`
+}
+
+type perfNetworkObjects struct {
+	ReportPacketSize *ebpf.Program `ebpf:"report_packet_size_perf"`
+	ReportIngress    *ebpf.Program `ebpf:"report_ingress_perf"`
+	ReportEgress     *ebpf.Program `ebpf:"report_egress_perf"`
+	ReportXdp        *ebpf.Program `ebpf:"report_xdp_perf"`
+	Events           *ebpf.Map     `ebpf:"perf_events"`
+	Flows            *ebpf.Map     `ebpf:"flows"`
+	ReportConfig     *ebpf.Map     `ebpf:"report_config"`
+	LostEvents       *ebpf.Map     `ebpf:"lost_events"`
+	FilterConfig     *ebpf.Map     `ebpf:"filter_config"`
+	FilterPorts      *ebpf.Map     `ebpf:"filter_ports"`
+	FilterPortRanges *ebpf.Map     `ebpf:"filter_port_ranges"`
+	FilterNets       *ebpf.Map     `ebpf:"filter_nets"`
+	FilterProtocols  *ebpf.Map     `ebpf:"filter_protocols"`
+	TargetSockets    *ebpf.Map     `ebpf:"target_sockets"`
+	TargetFlows      *ebpf.Map     `ebpf:"target_flows"`
+}
+
+func (objs *networkObjects) Close() {
+	objs.ReportPacketSize.Close()
+	objs.ReportIngress.Close()
+	objs.ReportEgress.Close()
+	objs.ReportXdp.Close()
+	objs.Events.Close()
+	objs.Flows.Close()
+	objs.ReportConfig.Close()
+	objs.LostEvents.Close()
+	objs.FilterConfig.Close()
+	objs.FilterPorts.Close()
+	objs.FilterPortRanges.Close()
+	objs.FilterNets.Close()
+	objs.FilterProtocols.Close()
+	objs.TargetSockets.Close()
+	objs.TargetFlows.Close()
+}
+
+// eventReader reads raw events from either a ring buffer or a perf event array.
+type eventReader interface {
+	// Read returns the next event and how many events the reader lost before it.
+	Read() ([]byte, uint64, error)
+	Close() error
+}
+
+type ringbufEventReader struct {
+	*ringbuf.Reader
+}
+
+func (reader ringbufEventReader) Read() ([]byte, uint64, error) {
+	record, err := reader.Reader.Read()
+	return record.RawSample, 0, err
+}
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go@main -type event tcACL ../../ebpf/tc_acl.c -- -I../../ebpf/include -nostdinc -O3
+type perfEventReader struct {
+	*perf.Reader
+}
+
+func (reader perfEventReader) Read() ([]byte, uint64, error) {
+	record, err := reader.Reader.Read()
+	return record.RawSample, record.LostSamples, err
+}
+
+// eventStream is the state shared by the reader goroutine and the goroutine
+// writing the events.
+type eventStream struct {
+	reader  eventReader
+	events  chan tcACLEvent
+	done    chan struct{}
+	pending []tcACLEvent
+	// lost counts events dropped by the reader, the program counts the events
+	// it could not submit and the packets it could not count in the
+	// lost_events map.
+	lost         uint64
+	lostReported [3]uint64
+}
 
 type NetworkTracer struct {
-	srcPort      int
-	destPort     int
-	ebpfObjs     *tcACLObjects
-	writer       *bufio.Writer
-	tickerTime   time.Duration
-	traceFile    *os.File
+	ebpfObjs   *networkObjects
+	stream     *eventStream
+	writer     *bufio.Writer
+	flowWriter *bufio.Writer
+	lostWriter *bufio.Writer
+	tickerTime time.Duration
+	traceFile  *os.File
+	flowFile   *os.File
+	lostFile   *os.File
+	// tcp follows the TCP connections in the events, written to tcpFile.
+	tcp       *tcpTracker
+	tcpWriter *bufio.Writer
+	tcpFile   *os.File
+	// attribution is fixed when the tracer is created, target follows the
+	// sockets of the process for ATTRIBUTE_SOCKET.
+	attribution Attribution
+	target      *targetSockets
+}
+
+// loadNetworkObjects loads the ring buffer program, or the perf event array
+// program on kernels older than 5.8.
+func loadNetworkObjects() (*networkObjects, eventReader, error) {
+	spec, err := loadTcACL()
+	if err != nil {
+		return nil, nil, err
+	}
+	if features.HaveMapType(ebpf.RingBuf) == nil {
+		var objs networkObjects
+		if err := spec.LoadAndAssign(&objs, nil); err != nil {
+			return nil, nil, err
+		}
+		reader, err := ringbuf.NewReader(objs.Events)
+		if err != nil {
+			objs.Close()
+			return nil, nil, err
+		}
+		return &objs, ringbufEventReader{reader}, nil
+	}
+	jww.INFO.Println("Ring buffers are not supported, using a perf event array")
+	var perfObjs perfNetworkObjects
+	if err := spec.LoadAndAssign(&perfObjs, nil); err != nil {
+		return nil, nil, err
+	}
+	objs := networkObjects(perfObjs)
+	reader, err := perf.NewReader(objs.Events, PERF_BUFFER_SIZE)
+	if err != nil {
+		objs.Close()
+		return nil, nil, err
+	}
+	return &objs, perfEventReader{reader}, nil
 }
 
-func NewNetworkTracer(srcPort, destPort int, appendFile bool) (NetworkTracer, error) {
+// NewNetworkTracer records the flows passing filter once its program is
+// attached, and every packet when packetEvents is set.
+func NewNetworkTracer(filter Filter, packetEvents bool, appendFile bool) (NetworkTracer, error) {
 	if err := rlimit.RemoveMemlock(); err != nil {
 		return NetworkTracer{}, err
 	}
-	var objs tcACLObjects
-	if err := loadTcACLObjects(&objs, nil); err != nil {
+	objs, reader, err := loadNetworkObjects()
+	if err != nil {
 		return NetworkTracer{}, err
 	}
-	var l *os.File
-	if !appendFile {
-		l, _ = os.Create("records/packets")
-	} else {
-		l, _ = os.OpenFile("records/packets", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	}
-	writer := bufio.NewWriter(l)
-	nt := NetworkTracer{
-		srcPort:      srcPort,
-		destPort:     destPort,
-		ebpfObjs:     &objs,
-		writer:	      writer,
-		tickerTime:   NET_STAT_TICKER_TIME,
-		traceFile:    l,
+	nt := NetworkTracer{ebpfObjs: objs, tickerTime: NET_STAT_TICKER_TIME}
+	nt.stream = &eventStream{reader: reader, events: make(chan tcACLEvent, EVENT_CHANNEL_SIZE), done: make(chan struct{})}
+	if err := nt.open(filter, packetEvents, appendFile); err != nil {
+		reader.Close()
+		nt.closeFiles()
+		objs.Close()
+		return NetworkTracer{}, err
 	}
+	go nt.stream.read()
+	go nt.run()
 	return nt, nil
 }
 
-func (tracer NetworkTracer) Start(ticker time.Ticker, stop chan bool) {
-	err := tracer.getEbpfObjects().PortHolder.Put(uint64(0), uint64(tracer.srcPort))
-	err = tracer.getEbpfObjects().PortHolder.Put(uint64(1), uint64(tracer.destPort))
-	keysOut = make([]uint64, 1000000)
-	valsOut = make([]tcACLEvent, 1000000)
-	if err != nil {
-		jww.INFO.Println(err)
+func (tracer *NetworkTracer) open(filter Filter, packetEvents bool, appendFile bool) error {
+	tracer.attribution = filter.Attribution
+	if err := loadFilter(tracer.ebpfObjs, filter); err != nil {
+		return err
+	}
+	if filter.Attribution.Mode == ATTRIBUTE_SOCKET {
+		target, err := newTargetSockets(filter.Attribution.Pid)
+		if err != nil {
+			return err
+		}
+		tracer.target = target
+		if err := target.sync(tracer.ebpfObjs); err != nil {
+			return err
+		}
+	}
+	if err := loadReportConfig(tracer.ebpfObjs, packetEvents); err != nil {
+		return err
+	}
+	var err error
+	if packetEvents {
+		if tracer.traceFile, err = pkg.OpenRecordFile("records/packets", appendFile); err != nil {
+			return err
+		}
+		tracer.writer = bufio.NewWriter(tracer.traceFile)
+		if tracer.tcpFile, err = pkg.OpenRecordFile("records/tcp_flows", appendFile); err != nil {
+			return err
+		}
+		tracer.tcpWriter = bufio.NewWriter(tracer.tcpFile)
+		tracer.tcp = newTCPTracker()
+	}
+	if tracer.flowFile, err = pkg.OpenRecordFile("records/flows", appendFile); err != nil {
+		return err
+	}
+	tracer.flowWriter = bufio.NewWriterSize(tracer.flowFile, 65536)
+	if tracer.lostFile, err = pkg.OpenRecordFile("records/packets_lost", appendFile); err != nil {
+		return err
+	}
+	tracer.lostWriter = bufio.NewWriter(tracer.lostFile)
+	return nil
+}
+
+func (tracer NetworkTracer) closeFiles() {
+	for _, f := range []*os.File{tracer.traceFile, tracer.flowFile, tracer.lostFile, tracer.tcpFile} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if tracer.target != nil {
+		tracer.target.Close()
+	}
+}
+
+// Start blocks until the tracer is torn down, events are written from the
+// moment the tracer is created.
+func (tracer NetworkTracer) Start() {
+	<-tracer.stream.done
+}
+
+// run writes the events in time order and the flows of every interval until
+// the events channel is closed.
+func (tracer NetworkTracer) run() {
+	defer close(tracer.stream.done)
+	ticker := time.NewTicker(tracer.tickerTime)
+	defer ticker.Stop()
+	flowTicker := time.NewTicker(FLOW_TICKER_TIME)
+	defer flowTicker.Stop()
+	var targetTick <-chan time.Time
+	if tracer.target != nil {
+		targetTicker := time.NewTicker(TARGET_TICKER_TIME)
+		defer targetTicker.Stop()
+		targetTick = targetTicker.C
 	}
 	for {
 		select {
+		case ev, ok := <-tracer.stream.events:
+			if !ok {
+				tracer.writeEvents(^uint64(0))
+				tracer.writeFlows()
+				tracer.writeTCPFlows()
+				tracer.writeLost()
+				return
+			}
+			tracer.stream.pending = append(tracer.stream.pending, ev)
 		case <-ticker.C:
-			tracer.tickFrameSize()
-		case <-stop:
-			tracer.TearDown()
-			return
+			tracer.writeEvents(pkg.GetMonoTime() - uint64(EVENT_REORDER_WINDOW))
+			tracer.writeLost()
+		case <-flowTicker.C:
+			tracer.writeFlows()
+			tracer.writeTCPFlows()
+		case <-targetTick:
+			if err := tracer.target.sync(tracer.getEbpfObjects()); err != nil {
+				jww.ERROR.Println(err)
+			}
 		}
 	}
 }
@@ -78,48 +305,128 @@ func (tracer NetworkTracer) GetTickerTime() time.Duration {
 	return tracer.tickerTime
 }
 
-
+// TearDown stops the reader and waits for the buffered events to be written.
 func (tracer NetworkTracer) TearDown() {
-	tracer.writer.Flush()
+	tracer.stream.reader.Close()
+	<-tracer.stream.done
 	tracer.ebpfObjs.Close()
-	tracer.traceFile.Close()
+	tracer.closeFiles()
 }
 
-func (tracer NetworkTracer) getEbpfObjects() *tcACLObjects {
+func (tracer NetworkTracer) getEbpfObjects() *networkObjects {
 	return tracer.ebpfObjs
 }
 
-func (tracer NetworkTracer) tickFrameSize() {
-	var nextKeyOut uint64
-	prevKey := new(uint64)
+// SetFilter replaces the filter of the attached program, keeping the
+// attribution the tracer was created with.
+func (tracer NetworkTracer) SetFilter(filter Filter) error {
+	filter.Attribution = tracer.attribution
+	return loadFilter(tracer.getEbpfObjects(), filter)
+}
+
+// read decodes events until the reader is closed, then closes the events
+// channel.
+func (stream *eventStream) read() {
+	defer close(stream.events)
 	for {
-		_, err := tracer.getEbpfObjects().Events.BatchLookupAndDelete(prevKey, &nextKeyOut, keysOut, valsOut, nil)
-		idx := uint64(0)
-		for keysOut[idx] != 0 && valsOut[idx].Sport != 0 {
-			// TODO: There is a bug here, some 0s for time has been seen.
-			data := fmt.Sprintf(
-				"%d,%d,%d,%d,%d,%d\n", 
-				keysOut[idx], 
-				valsOut[idx].Len, 
-				valsOut[idx].Saddr, 
-				valsOut[idx].Daddr, 
-				valsOut[idx].Sport, 
-				valsOut[idx].Dport, 
-			)
-			tracer.writer.WriteString(data)
-			idx++
-		}
+		raw, lost, err := stream.reader.Read()
 		if err != nil {
-			if errors.Is(err, ebpf.ErrKeyNotExist) {
-				prevKey = nil
-				break
-			} else {
+			if !errors.Is(err, os.ErrClosed) {
 				jww.ERROR.Println(err)
-				break
 			}
-		} else {
-			prevKey = &nextKeyOut
+			return
+		}
+		atomic.AddUint64(&stream.lost, lost)
+		if len(raw) == 0 {
+			continue
 		}
+		var ev tcACLEvent
+		if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &ev); err != nil {
+			jww.ERROR.Println(err)
+			continue
+		}
+		stream.events <- ev
 	}
+}
+
+// writeEvents writes the buffered events older than until in time order.
+func (tracer NetworkTracer) writeEvents(until uint64) {
+	pending := tracer.stream.pending
+	if len(pending) == 0 {
+		return
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].Ts < pending[j].Ts })
+	// Events carry bpf_ktime_get_ns timestamps, records use the wall clock.
+	wallOffset := uint64(time.Now().UnixNano()) - pkg.GetMonoTime()
+	idx := 0
+	for ; idx < len(pending) && pending[idx].Ts <= until; idx++ {
+		ev := pending[idx]
+		tracer.writer.WriteString(FormatPacket(
+			ev.Ts+wallOffset, ev.Len,
+			eventIP(ev.Saddr, ev.Family), eventIP(ev.Daddr, ev.Family),
+			ev.Sport, ev.Dport, ev.Protocol, ev.Direction,
+		))
+		// Fragments past the first carry no TCP header and are left with port 0.
+		if ev.Protocol == unix.IPPROTO_TCP && ev.Sport != 0 {
+			tracer.tcp.add(ev)
+		}
+	}
+	tracer.stream.pending = append(pending[:0], pending[idx:]...)
 	tracer.writer.Flush()
 }
+
+// writeTCPFlows writes the TCP records of the interval, when packet events are
+// read.
+func (tracer NetworkTracer) writeTCPFlows() {
+	if tracer.tcp == nil {
+		return
+	}
+	for _, record := range tracer.tcp.flush(uint64(time.Now().UnixNano())) {
+		tracer.tcpWriter.WriteString(record)
+	}
+	tracer.tcpWriter.Flush()
+}
+
+// writeLost records the total number of events the program could not submit,
+// the reader dropped and packets missing from the flows, whenever any changes.
+func (tracer NetworkTracer) writeLost() {
+	lost := [3]uint64{
+		tracer.kernelLost(LOST_EVENTS),
+		atomic.LoadUint64(&tracer.stream.lost),
+		tracer.kernelLost(LOST_FLOWS),
+	}
+	if lost == tracer.stream.lostReported {
+		return
+	}
+	tracer.stream.lostReported = lost
+	tracer.lostWriter.WriteString(fmt.Sprintf("%d,%d,%d,%d\n", time.Now().UnixNano(), lost[0], lost[1], lost[2]))
+	tracer.lostWriter.Flush()
+}
+
+// kernelLost sums a lost_events counter over all cpus.
+func (tracer NetworkTracer) kernelLost(key uint32) uint64 {
+	var perCPU []uint64
+	var total uint64
+	if err := tracer.getEbpfObjects().LostEvents.Lookup(key, &perCPU); err == nil {
+		for _, v := range perCPU {
+			total += v
+		}
+	}
+	return total
+}
+
+// FormatPacket returns the packets record line every network backend writes:
+// time, length, addresses, ports, protocol and direction. ICMP type and code
+// take the place of the ports.
+func FormatPacket(ts uint64, length uint64, saddr, daddr net.IP, sport, dport, protocol, direction uint64) string {
+	return fmt.Sprintf("%d,%d,%s,%s,%d,%d,%d,%d\n", ts, length, saddr, daddr, sport, dport, protocol, direction)
+}
+
+// eventIP returns the address of an event, which holds IPv4 addresses in the
+// first 4 bytes.
+func eventIP(addr [16]uint8, family uint64) net.IP {
+	if family == unix.AF_INET {
+		return net.IP(addr[:net.IPv4len])
+	}
+	return net.IP(addr[:])
+}
@@ -2,29 +2,51 @@ package ebpf
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
+	"io"
+	"net"
 	"os"
 	"time"
-	"io"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pfring"
 	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/sys/unix"
+	"ogomon/pkg"
+)
+
+const (
+	// Enough for Ethernet, IPv6 with a few extension headers and TCP.
+	PCAP_SNAPLEN = 128
 )
 
 type PacketCaptureTracer struct {
 	ring *pfring.Ring
+	ringDirection pfring.Direction
+	hardwareAddr net.HardwareAddr
 	writer *bufio.Writer
 	traceFile    *os.File
 }
 
-func NewPacketCaptureTracer(deviceName string, appendFile bool) (PacketCaptureTracer, error) {
-	ring, err := pfring.NewRing(deviceName, 56, pfring.FlagPromisc)
+func NewPacketCaptureTracer(deviceName string, directions []Direction, appendFile bool) (PacketCaptureTracer, error) {
+	iface, err := net.InterfaceByName(deviceName)
+	if err != nil {
+		return PacketCaptureTracer{}, err
+	}
+	ringDirection := pfring.ReceiveAndTransmit
+	if len(directions) == 1 && directions[0] == INGRESS {
+		ringDirection = pfring.ReceiveOnly
+	} else if len(directions) == 1 && directions[0] == EGRESS {
+		ringDirection = pfring.TransmitOnly
+	}
+	ring, err := pfring.NewRing(deviceName, PCAP_SNAPLEN, pfring.FlagPromisc)
 	if err != nil {
 		if err != nil {
 			return PacketCaptureTracer{}, err
 		}
+	} else if err := ring.SetDirection(ringDirection); err != nil {
+		return PacketCaptureTracer{}, err
 	} else if err := ring.SetSocketMode(pfring.ReadOnly); err != nil {
 		if err != nil {
 			return PacketCaptureTracer{}, err
@@ -34,14 +56,12 @@ func NewPacketCaptureTracer(deviceName string, appendFile bool) (PacketCaptureTr
 			return PacketCaptureTracer{}, err
 		}
 	}
-	var l *os.File
-	if !appendFile {
-		l, _ = os.Create("records/packets")
-	} else {
-		l, _ = os.OpenFile("records/packets", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	l, err := pkg.OpenRecordFile("records/packets", appendFile)
+	if err != nil {
+		return PacketCaptureTracer{}, err
 	}
 	writer := bufio.NewWriter(l)
-	return PacketCaptureTracer{ring: ring, writer: writer, traceFile: l}, nil
+	return PacketCaptureTracer{ring: ring, ringDirection: ringDirection, hardwareAddr: iface.HardwareAddr, writer: writer, traceFile: l}, nil
 }
 
 func (tracer PacketCaptureTracer) TearDown() {
@@ -65,25 +85,49 @@ func (tracer PacketCaptureTracer) Start() {
 			jww.ERROR.Println("Error:", err)
 			break
 		}
-		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			transport := packet.TransportLayer().TransportFlow()
-			network := packet.NetworkLayer().NetworkFlow()
-			src_ip := network.Src().String()
-			dest_ip := network.Dst().String()
-			src_port := transport.Src().String()
-			dest_port := transport.Dst().String()
-			length := packet.Metadata().Length
-			currentTime := packet.Metadata().Timestamp.UnixNano()
-			data := fmt.Sprintf(
-				"%d,%d,%s,%s,%s,%s\n",
-				currentTime,
-				length,
-				src_ip, 
-				dest_ip,
-				src_port,
-				dest_port, 
-			)
-			tracer.writer.WriteString(data)
+		var saddr, daddr net.IP
+		var protocol, sport, dport uint64
+		switch network := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			saddr, daddr, protocol = network.SrcIP, network.DstIP, uint64(network.Protocol)
+		case *layers.IPv6:
+			saddr, daddr, protocol = network.SrcIP, network.DstIP, uint64(network.NextHeader)
+		default:
+			continue
+		}
+		switch transport := packet.TransportLayer().(type) {
+		case *layers.TCP:
+			sport, dport, protocol = uint64(transport.SrcPort), uint64(transport.DstPort), unix.IPPROTO_TCP
+		case *layers.UDP:
+			sport, dport, protocol = uint64(transport.SrcPort), uint64(transport.DstPort), unix.IPPROTO_UDP
+		case *layers.UDPLite:
+			sport, dport, protocol = uint64(transport.SrcPort), uint64(transport.DstPort), unix.IPPROTO_UDPLITE
 		}
+		if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+			sport, dport, protocol = uint64(icmp.TypeCode.Type()), uint64(icmp.TypeCode.Code()), unix.IPPROTO_ICMP
+		} else if icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+			sport, dport, protocol = uint64(icmp.TypeCode.Type()), uint64(icmp.TypeCode.Code()), unix.IPPROTO_ICMPV6
+		}
+		tracer.writer.WriteString(FormatPacket(
+			uint64(packet.Metadata().Timestamp.UnixNano()),
+			uint64(packet.Metadata().Length),
+			saddr, daddr, sport, dport, protocol,
+			tracer.direction(packet),
+		))
+	}
+}
+
+// direction tells the direction of packet from the capture direction, or when
+// capturing both from whether the interface sent it.
+func (tracer PacketCaptureTracer) direction(packet gopacket.Packet) uint64 {
+	switch tracer.ringDirection {
+	case pfring.ReceiveOnly:
+		return EVENT_INGRESS
+	case pfring.TransmitOnly:
+		return EVENT_EGRESS
+	}
+	if eth, ok := packet.LinkLayer().(*layers.Ethernet); ok && bytes.Equal(eth.SrcMAC, tracer.hardwareAddr) {
+		return EVENT_EGRESS
 	}
+	return EVENT_INGRESS
 }
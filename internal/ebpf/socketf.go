@@ -1,6 +1,7 @@
 package ebpf
 
 import (
+	"fmt"
 	"golang.org/x/sys/unix"
 	"net"
 	"ogomon/pkg"
@@ -42,22 +43,33 @@ type FilterSocketTracer struct {
 	NetworkTracer
 }
 
-func NewFilterSocketTracer(deviceName string, srcPort, destPort int, appendFile bool) (FilterSocketTracer, error) {
+func NewFilterSocketTracer(deviceName string, filter Filter, packetEvents bool, appendFile bool) (FilterSocketTracer, error) {
 	iface := net.Interface{
 		Name: deviceName,
 	}
-	nt, err := NewNetworkTracer(srcPort, destPort, appendFile)
+	if filter.Attribution.Mode != ATTRIBUTE_NONE {
+		return FilterSocketTracer{}, fmt.Errorf("socket filters cannot attribute packets to a process, use the tc backend")
+	}
+	nt, err := NewNetworkTracer(filter, packetEvents, appendFile)
 	if err != nil {
 		return FilterSocketTracer{}, err
 	}
 	socket, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(pkg.Htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		nt.TearDown()
+		return FilterSocketTracer{}, err
+	}
 	err = syscall.BindToDevice(socket, iface.Name)
-	SetPromiscuous(iface, C.int(socket))
 	if err != nil {
+		syscall.Close(socket)
+		nt.TearDown()
 		return FilterSocketTracer{}, err
 	}
+	SetPromiscuous(iface, C.int(socket))
 	ssoErr := syscall.SetsockoptInt(socket, unix.SOL_SOCKET, unix.SO_ATTACH_BPF, nt.ebpfObjs.ReportPacketSize.FD())
 	if ssoErr != nil {
+		syscall.Close(socket)
+		nt.TearDown()
 		return FilterSocketTracer{}, ssoErr
 	}
 	return FilterSocketTracer{socketFD: socket, NetworkTracer: nt}, nil
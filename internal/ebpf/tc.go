@@ -2,6 +2,7 @@ package ebpf
 
 import (
 	"errors"
+	"github.com/cilium/ebpf"
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
@@ -12,10 +13,10 @@ const (
 	INGRESS
 )
 
-var (
-	keysOut []uint64
-	valsOut []tcACLEvent
-	qdisc   *netlink.GenericQdisc
+// Names of ogomon's tc filters, ogomon cleanup removes filters by these.
+const (
+	TC_FILTER_INGRESS = "report-ingress"
+	TC_FILTER_EGRESS  = "report-egress"
 )
 
 type TcFilter struct {
@@ -25,41 +26,51 @@ type TcFilter struct {
 type Direction uint32
 
 type TcNetworkTracer struct {
-	tcFilter  *TcFilter
-	direction Direction
+	tcFilters []*TcFilter
 	NetworkTracer
 }
 
 type Cleaner func()
 
-func NewTcNetworkTracer(deviceName string, srcPort, destPort int, direction Direction) (TcNetworkTracer, error) {
-	nt, err := NewNetworkTracer(srcPort, destPort, false)
+// NewTcNetworkTracer attaches one classifier per direction to deviceName, each
+// reporting its direction in the events.
+func NewTcNetworkTracer(deviceName string, filter Filter, directions []Direction, packetEvents bool, appendFile bool) (TcNetworkTracer, error) {
+	nt, err := NewNetworkTracer(filter, packetEvents, appendFile)
 	if err != nil {
 		return TcNetworkTracer{}, err
 	}
 
-	var netlinkDir uint32
-	if direction == EGRESS {
-		netlinkDir = netlink.HANDLE_MIN_EGRESS
-	} else if direction == INGRESS {
-		netlinkDir = netlink.HANDLE_MIN_INGRESS
-	} else {
-		return TcNetworkTracer{}, errors.New("undefined direction")
-	}
-	tcFilter, err := NewTcFilter(deviceName, netlinkDir, *nt.ebpfObjs)
-	if err != nil {
-		return TcNetworkTracer{}, err
+	tracer := TcNetworkTracer{NetworkTracer: nt}
+	for _, direction := range directions {
+		var netlinkDir uint32
+		var program *ebpf.Program
+		if direction == EGRESS {
+			netlinkDir = netlink.HANDLE_MIN_EGRESS
+			program = nt.ebpfObjs.ReportEgress
+		} else if direction == INGRESS {
+			netlinkDir = netlink.HANDLE_MIN_INGRESS
+			program = nt.ebpfObjs.ReportIngress
+		} else {
+			tracer.TearDown()
+			return TcNetworkTracer{}, errors.New("undefined direction")
+		}
+		tcFilter, err := NewTcFilter(deviceName, netlinkDir, program)
+		if err != nil {
+			tracer.TearDown()
+			return TcNetworkTracer{}, err
+		}
+		tracer.tcFilters = append(tracer.tcFilters, tcFilter)
 	}
-
-	return TcNetworkTracer{
-		tcFilter:      tcFilter,
-		NetworkTracer: nt,
-	}, nil
+	return tracer, nil
 }
 
+// TearDown removes the filters in reverse order, so the filter whose creation
+// added the clsact qdisc goes last and can delete it.
 func (tracer TcNetworkTracer) TearDown() {
+	for idx := len(tracer.tcFilters) - 1; idx >= 0; idx-- {
+		tracer.tcFilters[idx].TearDown()
+	}
 	tracer.NetworkTracer.TearDown()
-	tracer.tcFilter.TearDown()
 }
 
 func InitQdisc(link netlink.Link) *netlink.GenericQdisc {
@@ -68,14 +79,13 @@ func InitQdisc(link netlink.Link) *netlink.GenericQdisc {
 		Handle:    netlink.MakeHandle(0xffff, 0),
 		Parent:    netlink.HANDLE_CLSACT,
 	}
-	qdisc = &netlink.GenericQdisc{
+	return &netlink.GenericQdisc{
 		QdiscAttrs: attrs,
 		QdiscType:  "clsact",
 	}
-	return qdisc
 }
 
-func InitFilter(link netlink.Link, objs tcACLObjects, netlinkDir uint32) *netlink.BpfFilter {
+func InitFilter(link netlink.Link, program *ebpf.Program, netlinkDir uint32) *netlink.BpfFilter {
 	filterattrs := netlink.FilterAttrs{
 		LinkIndex: link.Attrs().Index,
 		Parent:    netlinkDir,
@@ -85,30 +95,37 @@ func InitFilter(link netlink.Link, objs tcACLObjects, netlinkDir uint32) *netlin
 	}
 	var name string
 	if netlinkDir == netlink.HANDLE_MIN_EGRESS {
-		name = "report-egress"
+		name = TC_FILTER_EGRESS
 	} else {
-		name = "report-ingress"
+		name = TC_FILTER_INGRESS
 	}
 	filter := &netlink.BpfFilter{
 		FilterAttrs:  filterattrs,
-		Fd:           objs.ReportPacketSize.FD(),
+		Fd:           program.FD(),
 		Name:         name,
 		DirectAction: true,
 	}
 	return filter
 }
 
-func NewTcFilter(deviceName string, netlinkDir uint32, filterObjs tcACLObjects) (*TcFilter, error) {
-	link, err := netlink.LinkByName(deviceName)
+// NewTcFilter attaches program to deviceName in the calling thread's network
+// namespace, which the teardown keeps using. The clsact qdisc is added when
+// the device has none, and only then deleted by the teardown, once no filters
+// are left on it.
+func NewTcFilter(deviceName string, netlinkDir uint32, program *ebpf.Program) (*TcFilter, error) {
+	handle, err := netlink.NewHandle()
 	if err != nil {
 		return &TcFilter{}, err
 	}
-
-	if qdisc == nil {
-		qdisc = InitQdisc(link)
+	link, err := handle.LinkByName(deviceName)
+	if err != nil {
+		handle.Delete()
+		return &TcFilter{}, err
 	}
-	filter := InitFilter(link, filterObjs, netlinkDir)
-	qdiscList, _ := netlink.QdiscList(link)
+
+	qdisc := InitQdisc(link)
+	filter := InitFilter(link, program, netlinkDir)
+	qdiscList, _ := handle.QdiscList(link)
 	addQdisc := true
 	for _, q := range qdiscList {
 		if q.Attrs().Parent == netlink.HANDLE_CLSACT {
@@ -117,28 +134,50 @@ func NewTcFilter(deviceName string, netlinkDir uint32, filterObjs tcACLObjects)
 		}
 	}
 	if addQdisc {
-		if err := netlink.QdiscAdd(qdisc); err != nil {
+		if err := handle.QdiscAdd(qdisc); err != nil {
 			jww.ERROR.Println("QdiscAdd err: ", err.Error())
+			handle.Delete()
 			return &TcFilter{}, err
 		}
 	}
-	if err := netlink.FilterAdd(filter); err != nil {
+	if err := handle.FilterAdd(filter); err != nil {
 		jww.ERROR.Println("FilterAdd err: ", err)
+		if addQdisc {
+			handle.QdiscDel(qdisc)
+		}
+		handle.Delete()
 		return &TcFilter{}, err
 	}
 
 	teardownFilter := func() {
-		netlink.FilterDel(filter)
-		netlink.QdiscDel(qdisc)
-		netlink.LinkSetXdpFdWithFlags(link, -1, xdpFlags((link).Type()))
+		if err := handle.FilterDel(filter); err != nil {
+			jww.ERROR.Println("FilterDel err: ", err)
+		}
+		if addQdisc && !hasFilters(handle, link) {
+			handle.QdiscDel(qdisc)
+		}
+		handle.Delete()
 	}
 
 	return &TcFilter{TearDown: teardownFilter}, nil
 }
 
+// hasFilters tells whether any filter is attached to the clsact qdisc of link.
+func hasFilters(handle *netlink.Handle, link netlink.Link) bool {
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filters, err := handle.FilterList(link, parent)
+		if err != nil || len(filters) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// xdpFlags returns the XDP mode to try first for a link type, generic for
+// virtual devices where native XDP brings nothing, native otherwise.
 func xdpFlags(linkType string) int {
 	if linkType == "veth" || linkType == "tuntap" {
-		return 2
+		return unix.XDP_FLAGS_SKB_MODE
 	}
-	return 0 // native xdp (xdpdrv) by default
+	return unix.XDP_FLAGS_DRV_MODE
 }
@@ -0,0 +1,225 @@
+package ebpf
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"ogomon/pkg"
+)
+
+// TCP flags of events.
+const (
+	TCP_FIN = 1 << iota
+	TCP_SYN
+	TCP_RST
+	TCP_PSH
+	TCP_ACK
+)
+
+const (
+	// Segments awaiting their ack per direction, older ones are forgotten.
+	TCP_UNACKED_SEGMENTS = 64
+	TCP_MAX_CONNECTIONS  = 65536
+	TCP_IDLE_TIMEOUT     = 2 * time.Minute
+)
+
+type tcpEndpoint struct {
+	Addr [16]uint8
+	Port uint16
+}
+
+// tcpConnKey names a connection the same for both directions, A sorts before
+// B.
+type tcpConnKey struct {
+	Family uint64
+	A      tcpEndpoint
+	B      tcpEndpoint
+}
+
+type tcpSegment struct {
+	end           uint32
+	ts            uint64
+	syn           bool
+	retransmitted bool
+}
+
+// tcpHalf is one direction of a connection. The counters cover the current
+// interval.
+type tcpHalf struct {
+	started bool
+	nextSeq uint32
+	unacked []tcpSegment
+	window  uint16
+
+	packets      uint64
+	bytes        uint64
+	retransmits  uint64
+	rttSamples   uint64
+	rttSum       uint64
+	rttMin       uint64
+	rttMax       uint64
+	handshakeRTT uint64
+}
+
+type tcpConn struct {
+	halves   [2]tcpHalf
+	lastSeen uint64
+}
+
+// tcpTracker follows the sequence numbers of TCP connections in packet events
+// to count retransmissions and measure round trip times, from a SYN to its
+// SYN-ACK and from data to its ACK. It needs both directions of a connection
+// and events in time order.
+type tcpTracker struct {
+	conns map[tcpConnKey]*tcpConn
+}
+
+func newTCPTracker() *tcpTracker {
+	return &tcpTracker{conns: make(map[tcpConnKey]*tcpConn)}
+}
+
+// seqAfter compares sequence numbers across wrap around.
+func seqAfter(a uint32, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func (tracker *tcpTracker) add(ev tcACLEvent) {
+	src := tcpEndpoint{Addr: ev.Saddr, Port: uint16(ev.Sport)}
+	dst := tcpEndpoint{Addr: ev.Daddr, Port: uint16(ev.Dport)}
+	key := tcpConnKey{Family: ev.Family, A: src, B: dst}
+	sender := 0
+	if cmp := bytes.Compare(dst.Addr[:], src.Addr[:]); cmp < 0 || (cmp == 0 && dst.Port < src.Port) {
+		key.A, key.B = dst, src
+		sender = 1
+	}
+	conn := tracker.conns[key]
+	if conn == nil {
+		if len(tracker.conns) >= TCP_MAX_CONNECTIONS {
+			return
+		}
+		conn = &tcpConn{}
+		tracker.conns[key] = conn
+	}
+	if ev.TcpFlags&TCP_RST != 0 {
+		delete(tracker.conns, key)
+		return
+	}
+	conn.lastSeen = ev.Ts
+
+	half := &conn.halves[sender]
+	half.packets++
+	half.bytes += uint64(ev.PayloadLen)
+	half.window = ev.Window
+	// SYN and FIN take a sequence number like a byte of data.
+	length := ev.PayloadLen
+	if ev.TcpFlags&TCP_SYN != 0 {
+		length++
+	}
+	if ev.TcpFlags&TCP_FIN != 0 {
+		length++
+	}
+	if length > 0 {
+		half.send(ev.Seq, ev.Seq+length, ev.Ts, ev.TcpFlags&TCP_SYN != 0)
+	}
+	if ev.TcpFlags&TCP_ACK != 0 {
+		conn.halves[1-sender].ack(ev.AckSeq, ev.Ts)
+	}
+}
+
+// send records a segment covering seq to end, a retransmission when it ends
+// no later than data sent before.
+func (half *tcpHalf) send(seq uint32, end uint32, ts uint64, syn bool) {
+	if half.started && !seqAfter(end, half.nextSeq) {
+		half.retransmits++
+		// Karn's algorithm, acks of retransmitted segments are ambiguous.
+		for idx := range half.unacked {
+			if seqAfter(half.unacked[idx].end, seq) {
+				half.unacked[idx].retransmitted = true
+			}
+		}
+		return
+	}
+	half.started = true
+	half.nextSeq = end
+	if len(half.unacked) >= TCP_UNACKED_SEGMENTS {
+		half.unacked = append(half.unacked[:0], half.unacked[1:]...)
+	}
+	half.unacked = append(half.unacked, tcpSegment{end: end, ts: ts, syn: syn})
+}
+
+// ack removes the segments ackSeq covers and takes a round trip time sample
+// from the last of them.
+func (half *tcpHalf) ack(ackSeq uint32, ts uint64) {
+	acked := -1
+	for idx, segment := range half.unacked {
+		if seqAfter(segment.end, ackSeq) {
+			break
+		}
+		acked = idx
+	}
+	if acked < 0 {
+		return
+	}
+	segment := half.unacked[acked]
+	half.unacked = append(half.unacked[:0], half.unacked[acked+1:]...)
+	if segment.retransmitted || ts < segment.ts {
+		return
+	}
+	rtt := ts - segment.ts
+	if half.rttSamples == 0 || rtt < half.rttMin {
+		half.rttMin = rtt
+	}
+	if rtt > half.rttMax {
+		half.rttMax = rtt
+	}
+	half.rttSamples++
+	half.rttSum += rtt
+	if segment.syn {
+		half.handshakeRTT = rtt
+	}
+}
+
+// formatTCPFlow writes the record of one direction of a connection over an
+// interval: its end, the sender's and receiver's address and port, packets,
+// payload bytes, retransmissions, round trip time samples with their minimum,
+// mean and maximum, the handshake round trip time and the last window. Times
+// are in nanoseconds, zero without samples.
+func formatTCPFlow(ts uint64, family uint64, src tcpEndpoint, dst tcpEndpoint, half *tcpHalf) string {
+	var rttMean uint64
+	if half.rttSamples > 0 {
+		rttMean = half.rttSum / half.rttSamples
+	}
+	return fmt.Sprintf(
+		"%d,%s,%s,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d\n",
+		ts, eventIP(src.Addr, family), eventIP(dst.Addr, family), src.Port, dst.Port,
+		half.packets, half.bytes, half.retransmits,
+		half.rttSamples, half.rttMin, rttMean, half.rttMax, half.handshakeRTT, half.window,
+	)
+}
+
+// flush returns the records of the directions active since the last call,
+// resets their counters and forgets idle connections.
+func (tracker *tcpTracker) flush(ts uint64) []string {
+	var records []string
+	now := pkg.GetMonoTime()
+	for key, conn := range tracker.conns {
+		for sender := range conn.halves {
+			half := &conn.halves[sender]
+			if half.packets == 0 {
+				continue
+			}
+			src, dst := key.A, key.B
+			if sender == 1 {
+				src, dst = dst, src
+			}
+			records = append(records, formatTCPFlow(ts, key.Family, src, dst, half))
+			half.packets, half.bytes, half.retransmits = 0, 0, 0
+			half.rttSamples, half.rttSum, half.rttMin, half.rttMax, half.handshakeRTT = 0, 0, 0, 0, 0
+		}
+		if now > conn.lastSeen && now-conn.lastSeen > uint64(TCP_IDLE_TIMEOUT) {
+			delete(tracker.conns, key)
+		}
+	}
+	return records
+}
@@ -0,0 +1,157 @@
+package ebpf
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// segment is a packet between the client 10.0.0.1:40000 and the server
+// 10.0.0.2:80, the client sorts first so it is halves[0] of the connection.
+type segment struct {
+	ts      uint64
+	client  bool
+	flags   uint8
+	seq     uint32
+	ack     uint32
+	payload uint32
+}
+
+func (s segment) event() tcACLEvent {
+	ev := tcACLEvent{
+		Ts:         s.ts,
+		Family:     unix.AF_INET,
+		Protocol:   unix.IPPROTO_TCP,
+		Seq:        s.seq,
+		AckSeq:     s.ack,
+		PayloadLen: s.payload,
+		TcpFlags:   s.flags,
+	}
+	client, server := [16]uint8{10, 0, 0, 1}, [16]uint8{10, 0, 0, 2}
+	if s.client {
+		ev.Saddr, ev.Daddr, ev.Sport, ev.Dport = client, server, 40000, 80
+	} else {
+		ev.Saddr, ev.Daddr, ev.Sport, ev.Dport = server, client, 80, 40000
+	}
+	return ev
+}
+
+// halfStats are the counters of one direction checked by the tests.
+type halfStats struct {
+	packets      uint64
+	bytes        uint64
+	retransmits  uint64
+	rttSamples   uint64
+	rttMin       uint64
+	rttMax       uint64
+	handshakeRTT uint64
+}
+
+func statsOf(half *tcpHalf) halfStats {
+	return halfStats{half.packets, half.bytes, half.retransmits, half.rttSamples, half.rttMin, half.rttMax, half.handshakeRTT}
+}
+
+var handshake = []segment{
+	{ts: 1000, client: true, flags: TCP_SYN, seq: 100},
+	{ts: 1500, flags: TCP_SYN | TCP_ACK, seq: 500, ack: 101},
+	{ts: 1600, client: true, flags: TCP_ACK, seq: 101, ack: 501},
+}
+
+func TestTCPTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []segment
+		conns    int
+		client   halfStats
+		server   halfStats
+	}{
+		{
+			name:     "handshake",
+			segments: handshake,
+			conns:    1,
+			client:   halfStats{packets: 2, rttSamples: 1, rttMin: 500, rttMax: 500, handshakeRTT: 500},
+			server:   halfStats{packets: 1, rttSamples: 1, rttMin: 100, rttMax: 100, handshakeRTT: 100},
+		},
+		{
+			name: "data acked",
+			segments: append(handshake[:3:3],
+				segment{ts: 2000, client: true, flags: TCP_ACK | TCP_PSH, seq: 101, ack: 501, payload: 100},
+				segment{ts: 2100, client: true, flags: TCP_ACK | TCP_PSH, seq: 201, ack: 501, payload: 100},
+				// One ack for both segments samples the last.
+				segment{ts: 2400, flags: TCP_ACK, seq: 501, ack: 301},
+				segment{ts: 3000, client: true, flags: TCP_ACK | TCP_PSH, seq: 301, ack: 501, payload: 50},
+				segment{ts: 3050, flags: TCP_ACK, seq: 501, ack: 351},
+			),
+			conns:  1,
+			client: halfStats{packets: 5, bytes: 250, rttSamples: 3, rttMin: 50, rttMax: 500, handshakeRTT: 500},
+			server: halfStats{packets: 3, rttSamples: 1, rttMin: 100, rttMax: 100, handshakeRTT: 100},
+		},
+		{
+			name: "retransmission excluded from rtt",
+			segments: append(handshake[:3:3],
+				segment{ts: 2000, client: true, flags: TCP_ACK | TCP_PSH, seq: 101, ack: 501, payload: 100},
+				segment{ts: 2500, client: true, flags: TCP_ACK | TCP_PSH, seq: 101, ack: 501, payload: 100},
+				segment{ts: 2600, flags: TCP_ACK, seq: 501, ack: 201},
+			),
+			conns:  1,
+			client: halfStats{packets: 4, bytes: 200, retransmits: 1, rttSamples: 1, rttMin: 500, rttMax: 500, handshakeRTT: 500},
+			server: halfStats{packets: 2, rttSamples: 1, rttMin: 100, rttMax: 100, handshakeRTT: 100},
+		},
+		{
+			name: "sequence wraparound",
+			segments: []segment{
+				{ts: 1000, client: true, flags: TCP_ACK, seq: 0xffffff00, ack: 1, payload: 0x80},
+				{ts: 1100, client: true, flags: TCP_ACK, seq: 0xffffff80, ack: 1, payload: 0x100},
+				{ts: 1300, flags: TCP_ACK, seq: 1, ack: 0x80},
+				// Behind the data sent, a retransmission despite the larger number.
+				{ts: 1400, client: true, flags: TCP_ACK, seq: 0xffffff80, ack: 1, payload: 0x100},
+			},
+			conns:  1,
+			client: halfStats{packets: 3, bytes: 0x280, retransmits: 1, rttSamples: 1, rttMin: 200, rttMax: 200},
+			server: halfStats{packets: 1},
+		},
+		{
+			name: "reset forgets the connection",
+			segments: append(handshake[:3:3],
+				segment{ts: 2000, flags: TCP_RST, seq: 501},
+			),
+			conns: 0,
+		},
+	}
+	for _, test := range tests {
+		tracker := newTCPTracker()
+		for _, s := range test.segments {
+			tracker.add(s.event())
+		}
+		if len(tracker.conns) != test.conns {
+			t.Errorf("%s: %d connections, want %d", test.name, len(tracker.conns), test.conns)
+			continue
+		}
+		for _, conn := range tracker.conns {
+			if got := statsOf(&conn.halves[0]); got != test.client {
+				t.Errorf("%s: client %+v, want %+v", test.name, got, test.client)
+			}
+			if got := statsOf(&conn.halves[1]); got != test.server {
+				t.Errorf("%s: server %+v, want %+v", test.name, got, test.server)
+			}
+		}
+	}
+}
+
+func TestSeqAfter(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{1, 1, false},
+		{0x10, 0xfffffff0, true},
+		{0xfffffff0, 0x10, false},
+	}
+	for _, test := range tests {
+		if got := seqAfter(test.a, test.b); got != test.want {
+			t.Errorf("seqAfter(%#x, %#x) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"ogomon/pkg"
+)
+
+// XdpNetworkTracer reports the packets a device receives from XDP, before the
+// kernel builds an skb for them. It sees no egress packets.
+type XdpNetworkTracer struct {
+	linkIndex int
+	flags     int
+	// netNS is the network namespace of the device, the program is detached
+	// from there.
+	netNS *os.File
+	NetworkTracer
+}
+
+// NewXdpNetworkTracer attaches the XDP program to deviceName in the calling
+// thread's network namespace, in generic mode when the driver has no native
+// XDP. It fails rather than replace a program already attached to the device.
+func NewXdpNetworkTracer(deviceName string, filter Filter, packetEvents bool, appendFile bool) (XdpNetworkTracer, error) {
+	if filter.Attribution.Mode == ATTRIBUTE_CGROUP {
+		// The cgroup only tells the flows of the target from its egress packets.
+		return XdpNetworkTracer{}, fmt.Errorf("XDP cannot attribute packets by cgroup, use socket attribution")
+	}
+	link, err := netlink.LinkByName(deviceName)
+	if err != nil {
+		return XdpNetworkTracer{}, err
+	}
+	netNS, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return XdpNetworkTracer{}, err
+	}
+	nt, err := NewNetworkTracer(filter, packetEvents, appendFile)
+	if err != nil {
+		netNS.Close()
+		return XdpNetworkTracer{}, err
+	}
+
+	flags, err := attachXdp(link, nt.ebpfObjs.ReportXdp.FD())
+	if err != nil {
+		netNS.Close()
+		nt.TearDown()
+		return XdpNetworkTracer{}, fmt.Errorf("attaching XDP program to %s: %w", deviceName, err)
+	}
+	// Detaching has to name the mode the program was attached in.
+	return XdpNetworkTracer{linkIndex: link.Attrs().Index, flags: flags, netNS: netNS, NetworkTracer: nt}, nil
+}
+
+// attachXdp attaches the program fd to link and returns the mode it runs in.
+// Drivers without native XDP refuse the native mode with EOPNOTSUPP, or EINVAL
+// for some, then the generic mode is used.
+func attachXdp(link netlink.Link, fd int) (int, error) {
+	flags := xdpFlags(link.Type())
+	err := netlink.LinkSetXdpFdWithFlags(link, fd, flags|unix.XDP_FLAGS_UPDATE_IF_NOEXIST)
+	if flags == unix.XDP_FLAGS_SKB_MODE || !(errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)) {
+		return flags, err
+	}
+	jww.INFO.Printf("%s has no native XDP, attaching in generic mode", link.Attrs().Name)
+	flags = unix.XDP_FLAGS_SKB_MODE
+	return flags, netlink.LinkSetXdpFdWithFlags(link, fd, flags|unix.XDP_FLAGS_UPDATE_IF_NOEXIST)
+}
+
+// detachXdpAnyMode removes program progID from the device of link when the
+// mode it was attached in is unknown, trying the native mode of the device
+// first and then the generic one.
+func detachXdpAnyMode(link netlink.Link, progID uint32) error {
+	var err error
+	for _, flags := range []int{xdpFlags(link.Type()), unix.XDP_FLAGS_SKB_MODE} {
+		err = netlink.LinkSetXdpFdWithFlags(link, -1, flags)
+		current, linkErr := netlink.LinkByIndex(link.Attrs().Index)
+		if linkErr != nil {
+			return linkErr
+		}
+		if xdp := current.Attrs().Xdp; xdp == nil || !xdp.Attached || xdp.ProgId != progID {
+			return nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("program %d is still attached", progID)
+	}
+	return err
+}
+
+func (tracer XdpNetworkTracer) TearDown() {
+	nsPath := fmt.Sprintf("/proc/self/fd/%d", tracer.netNS.Fd())
+	if err := pkg.RunInNetNS(nsPath, tracer.detach); err != nil {
+		jww.ERROR.Println("Detaching XDP program: ", err)
+	}
+	tracer.netNS.Close()
+	tracer.NetworkTracer.TearDown()
+}
+
+// detach removes the program from the device, unless it was replaced since.
+func (tracer XdpNetworkTracer) detach() error {
+	link, err := netlink.LinkByIndex(tracer.linkIndex)
+	if err != nil {
+		return err
+	}
+	info, err := tracer.ebpfObjs.ReportXdp.Info()
+	if err != nil {
+		return err
+	}
+	xdp := link.Attrs().Xdp
+	if id, ok := info.ID(); ok && (xdp == nil || xdp.ProgId != uint32(id)) {
+		return nil
+	}
+	return netlink.LinkSetXdpFdWithFlags(link, -1, tracer.flags)
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+
+	"ogomon/pkg"
+
+	"github.com/prometheus/procfs"
+)
+
+const (
+	FD_TICKER_TIME     = 100 * time.Millisecond
+	FD_LEAK_WINDOW     = time.Minute
+	FD_LEAK_MIN_GROWTH = 16
+)
+
+// Descriptor types in the column order of records/fds.
+const (
+	FD_FILE = iota
+	FD_SOCKET
+	FD_PIPE
+	FD_EVENTFD
+	FD_ANON_INODE
+	FD_DEVICE
+	FD_OTHER
+	FD_TYPES
+)
+
+// fdType classifies a descriptor by the target of its /proc/<pid>/fd link.
+func fdType(target string) int {
+	switch {
+	case strings.HasPrefix(target, "socket:"):
+		return FD_SOCKET
+	case strings.HasPrefix(target, "pipe:"):
+		return FD_PIPE
+	case target == "anon_inode:[eventfd]":
+		return FD_EVENTFD
+	case strings.HasPrefix(target, "anon_inode:"):
+		return FD_ANON_INODE
+	case strings.HasPrefix(target, "/dev/"):
+		return FD_DEVICE
+	case strings.HasPrefix(target, "/"):
+		return FD_FILE
+	}
+	return FD_OTHER
+}
+
+// NewFileDescriptorTracer records the open descriptors of the target by type
+// together with its RLIMIT_NOFILE. When the descriptor count grows without ever
+// dropping for a whole leakWindow, a suspected leak is logged to the session.
+func NewFileDescriptorTracer(proc *procfs.Proc, session *Session, leakWindow time.Duration, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/fds", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	samples := int(leakWindow / FD_TICKER_TIME)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newFileDescriptorTicker(session, samples), writer: writer, tickerTime: FD_TICKER_TIME}, nil
+}
+
+func newFileDescriptorTicker(session *Session, samples int) DataTicker {
+	var window []int
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		targets, _ := tracer.proc.FileDescriptorTargets()
+		var counts [FD_TYPES]int
+		for _, target := range targets {
+			counts[fdType(target)]++
+		}
+		limits, _ := tracer.proc.Limits()
+		logData := fmt.Sprintf(
+			"%d,%d,%d,%d,%d,%d,%d,%d,%d,%d\n",
+			evTime, len(targets),
+			counts[FD_FILE], counts[FD_SOCKET], counts[FD_PIPE], counts[FD_EVENTFD],
+			counts[FD_ANON_INODE], counts[FD_DEVICE], counts[FD_OTHER],
+			limits.OpenFiles,
+		)
+		tracer.writer.WriteString(logData)
+
+		if samples < 2 {
+			return evTime
+		}
+		if len(window) > 0 && len(targets) < window[len(window)-1] {
+			window = window[:0]
+		}
+		window = append(window, len(targets))
+		if len(window) == samples {
+			if window[len(window)-1]-window[0] >= FD_LEAK_MIN_GROWTH {
+				session.LogEvent(
+					"fd_leak", "pid=%d descriptors grew from %d to %d over %s without closing",
+					tracer.proc.PID, window[0], window[len(window)-1], time.Duration(samples)*tracer.tickerTime,
+				)
+				window = window[:0]
+			} else {
+				window = window[1:]
+			}
+		}
+		return evTime
+	}
+}
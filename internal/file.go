@@ -23,9 +23,9 @@ func LogTrace(ch chan Trace, filename string) {
 			data = strconv.FormatUint(trace.Data.(uint64), 10)
 		case NetworkTrace:
 			nt := trace.Data.(NetworkTrace)
-			sport, dport, length, dir, saddr, daddr := nt.Sport, nt.Dport, nt.Len, nt.Direction, nt.Saddr, nt.Daddr
+			sport, dport, length, dir, saddr, daddr, proto := nt.Sport, nt.Dport, nt.Len, nt.Direction, nt.Saddr, nt.Daddr, nt.Protocol
 			data = fmt.Sprintf(
-				"%d,%d,%d,%d,%d,%d", length, saddr, daddr, sport, dport, dir,
+				"%d,%s,%s,%d,%d,%d,%d", length, saddr, daddr, sport, dport, proto, dir,
 			)
 		}
 		_, err := f.WriteString(fmt.Sprintf("%s,%s\n", strconv.FormatUint(trace.TS, 10), data))
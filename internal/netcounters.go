@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"ogomon/pkg"
+
+	"github.com/prometheus/procfs"
+)
+
+const (
+	NET_COUNTER_TICKER_TIME = 100 * time.Millisecond
+)
+
+// protoCounters are the /proc/net/snmp and /proc/net/netstat counters recorded,
+// in output column order, as "<section>.<name>".
+var protoCounters = []string{"Tcp.RetransSegs", "Tcp.InErrs", "TcpExt.ListenDrops", "TcpExt.TCPTimeouts", "Udp.RcvbufErrors"}
+
+// readProtoCounters parses a /proc/net/snmp style file, where every section is
+// a line of names followed by a line of values.
+func readProtoCounters(filename string, counters map[string]uint64) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var names []string
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if names == nil || names[0] != fields[0] {
+			names = fields
+			continue
+		}
+		section := strings.TrimSuffix(fields[0], ":")
+		for i := 1; i < len(fields) && i < len(names); i++ {
+			if v, err := strconv.ParseUint(fields[i], 10, 64); err == nil {
+				counters[section+"."+names[i]] = v
+			}
+		}
+		names = nil
+	}
+	return scanner.Err()
+}
+
+// writeCounters writes values followed by their increase since prev. The
+// increase is zero on the first tick.
+func writeCounters(evTime uint64, values []uint64, prev []uint64) string {
+	var logData strings.Builder
+	logData.WriteString(strconv.FormatUint(evTime, 10))
+	for _, v := range values {
+		logData.WriteByte(',')
+		logData.WriteString(strconv.FormatUint(v, 10))
+	}
+	for i, v := range values {
+		var delta uint64
+		if prev != nil && v >= prev[i] {
+			delta = v - prev[i]
+		}
+		logData.WriteByte(',')
+		logData.WriteString(strconv.FormatUint(delta, 10))
+	}
+	logData.WriteByte('\n')
+	return logData.String()
+}
+
+// NewNetDevTracer records the /proc/net/dev counters of deviceName in the
+// target's network namespace: bytes, packets, errors and drops received, then
+// transmitted, followed by their per interval deltas.
+func NewNetDevTracer(proc *procfs.Proc, deviceName string, appendFile bool) (*SystemTracer, error) {
+	if deviceName == "" {
+		return nil, fmt.Errorf("no device name")
+	}
+	logFile, err := pkg.OpenRecordFile("records/netdev", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newNetDevTicker(deviceName), writer: writer, tickerTime: NET_COUNTER_TICKER_TIME}, nil
+}
+
+// NewNetProtoTracer records TCP retransmitted segments, TCP input errors,
+// listen drops, TCP timeouts and UDP receive buffer errors of the target's
+// network namespace, followed by their per interval deltas.
+func NewNetProtoTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/netproto", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newNetProtoTicker(), writer: writer, tickerTime: NET_COUNTER_TICKER_TIME}, nil
+}
+
+func newNetDevTicker(deviceName string) DataTicker {
+	var prev []uint64
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		netDev, err := tracer.proc.NetDev()
+		if err != nil {
+			return evTime
+		}
+		dev, ok := netDev[deviceName]
+		if !ok {
+			return evTime
+		}
+		values := []uint64{
+			dev.RxBytes, dev.RxPackets, dev.RxErrors, dev.RxDropped,
+			dev.TxBytes, dev.TxPackets, dev.TxErrors, dev.TxDropped,
+		}
+		tracer.writer.WriteString(writeCounters(evTime, values, prev))
+		prev = values
+		return evTime
+	}
+}
+
+func newNetProtoTicker() DataTicker {
+	var prev []uint64
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		netDir := filepath.Join(procfs.DefaultMountPoint, strconv.Itoa(tracer.proc.PID), "net")
+		counters := make(map[string]uint64)
+		readProtoCounters(filepath.Join(netDir, "snmp"), counters)
+		readProtoCounters(filepath.Join(netDir, "netstat"), counters)
+		values := make([]uint64, len(protoCounters))
+		for i, name := range protoCounters {
+			values[i] = counters[name]
+		}
+		tracer.writer.WriteString(writeCounters(evTime, values, prev))
+		prev = values
+		return evTime
+	}
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ogomon/pkg"
+
+	"github.com/prometheus/procfs"
+)
+
+const (
+	PSI_TICKER_TIME = 100 * time.Millisecond
+)
+
+var psiResources = []string{"cpu", "memory", "io"}
+
+// parsePressure parses a pressure file, which has the same format in
+// /proc/pressure and in cgroup v2 directories.
+func parsePressure(filename string) (procfs.PSIStats, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return procfs.PSIStats{}, err
+	}
+	defer f.Close()
+	var stats procfs.PSIStats
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var kind string
+		var line procfs.PSILine
+		_, err := fmt.Sscanf(scanner.Text(), "%s avg10=%f avg60=%f avg300=%f total=%d", &kind, &line.Avg10, &line.Avg60, &line.Avg300, &line.Total)
+		if err != nil {
+			continue
+		}
+		switch kind {
+		case "some":
+			stats.Some = &line
+		case "full":
+			stats.Full = &line
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// formatPressure writes avg10, avg60 and total of the some and full lines.
+// Lines the kernel does not provide, like full for cpu before 5.13, are zero.
+func formatPressure(evTime uint64, resource string, stats procfs.PSIStats) string {
+	some, full := procfs.PSILine{}, procfs.PSILine{}
+	if stats.Some != nil {
+		some = *stats.Some
+	}
+	if stats.Full != nil {
+		full = *stats.Full
+	}
+	return fmt.Sprintf(
+		"%d,%s,%.2f,%.2f,%d,%.2f,%.2f,%d\n",
+		evTime, resource,
+		some.Avg10, some.Avg60, some.Total,
+		full.Avg10, full.Avg60, full.Total,
+	)
+}
+
+// NewPressureTracer records the system wide pressure stall information of cpu,
+// memory and io, one line per resource and tick.
+func NewPressureTracer(fs *procfs.FS, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/pressure", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{fs: fs, logFile: logFile, ticker: tickPressure, writer: writer, tickerTime: PSI_TICKER_TIME}, nil
+}
+
+// NewCgroupPressureTracer records the pressure stall information of the cgroup
+// v2 the target runs in. It fails when the target is not in a cgroup v2.
+func NewCgroupPressureTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	cgroupPath, err := pkg.CgroupV2Path(*proc)
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := pkg.OpenRecordFile("records/cgroup_pressure", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newCgroupPressureTicker(cgroupPath), writer: writer, tickerTime: PSI_TICKER_TIME}, nil
+}
+
+func tickPressure(tracer *SystemTracer) uint64 {
+	evTime := GetEventTime()
+	var logData strings.Builder
+	for _, resource := range psiResources {
+		stats, err := tracer.fs.PSIStatsForResource(resource)
+		if err != nil {
+			continue
+		}
+		logData.WriteString(formatPressure(evTime, resource, stats))
+	}
+	tracer.writer.WriteString(logData.String())
+	return evTime
+}
+
+func newCgroupPressureTicker(cgroupPath string) DataTicker {
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		var logData strings.Builder
+		for _, resource := range psiResources {
+			stats, err := parsePressure(filepath.Join(cgroupPath, resource+".pressure"))
+			if err != nil {
+				continue
+			}
+			logData.WriteString(formatPressure(evTime, resource, stats))
+		}
+		tracer.writer.WriteString(logData.String())
+		return evTime
+	}
+}
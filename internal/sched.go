@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"ogomon/pkg"
+
+	"github.com/prometheus/procfs"
+)
+
+// Every tick reads a file per thread of the target.
+const SCHED_TICKER_TIME = 100 * time.Millisecond
+
+// procThreads lists the threads of proc. Each thread is exposed as a procfs.Proc
+// rooted at /proc/<pid>/task so the per-task files can be read with procfs.
+func procThreads(proc *procfs.Proc) (procfs.Procs, error) {
+	fs, err := procfs.NewFS(filepath.Join(procfs.DefaultMountPoint, strconv.Itoa(proc.PID), "task"))
+	if err != nil {
+		return nil, err
+	}
+	return fs.AllProcs()
+}
+
+// threadTotals sums per thread counters over the life of the target. Threads
+// that exited keep the last value read from them, so the totals never go down.
+// The container tracer uses it for processes the same way.
+type threadTotals struct {
+	last   map[int][]uint64
+	exited []uint64
+}
+
+func newThreadTotals(counters int) *threadTotals {
+	return &threadTotals{last: make(map[int][]uint64), exited: make([]uint64, counters)}
+}
+
+// update takes the counters of the live threads by thread id and returns the
+// totals. A thread id whose counters went down was reused by a new thread.
+func (totals *threadTotals) update(current map[int][]uint64) []uint64 {
+	for tid, last := range totals.last {
+		values, alive := current[tid]
+		if alive && values[0] >= last[0] {
+			continue
+		}
+		for idx := range last {
+			totals.exited[idx] += last[idx]
+		}
+	}
+	totals.last = current
+	sums := append([]uint64(nil), totals.exited...)
+	for _, values := range current {
+		for idx := range values {
+			sums[idx] += values[idx]
+		}
+	}
+	return sums
+}
+
+// NewContextSwitchTracer records voluntary and nonvoluntary context switches
+// summed over the threads of the target, including the ones that exited.
+func NewContextSwitchTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/ctx_switches", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newContextSwitchTicker(), writer: writer, tickerTime: SCHED_TICKER_TIME}, nil
+}
+
+// NewSchedDelayTracer records time spent on the cpu, time spent waiting on a
+// run queue and the number of timeslices run, summed over the threads of the
+// target, including the ones that exited.
+func NewSchedDelayTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/sched_delay", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newSchedDelayTicker(), writer: writer, tickerTime: SCHED_TICKER_TIME}, nil
+}
+
+func newContextSwitchTicker() DataTicker {
+	totals := newThreadTotals(2)
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		threads, _ := procThreads(tracer.proc)
+		current := make(map[int][]uint64, len(threads))
+		for _, thread := range threads {
+			status, err := thread.NewStatus()
+			if err != nil {
+				continue
+			}
+			current[thread.PID] = []uint64{status.VoluntaryCtxtSwitches, status.NonVoluntaryCtxtSwitches}
+		}
+		sums := totals.update(current)
+		logData := fmt.Sprintf("%d,%d,%d\n", evTime, sums[0], sums[1])
+		tracer.writer.WriteString(logData)
+		return evTime
+	}
+}
+
+func newSchedDelayTicker() DataTicker {
+	totals := newThreadTotals(3)
+	return func(tracer *SystemTracer) uint64 {
+		evTime := GetEventTime()
+		threads, _ := procThreads(tracer.proc)
+		current := make(map[int][]uint64, len(threads))
+		for _, thread := range threads {
+			stat, err := thread.Schedstat()
+			if err != nil {
+				continue
+			}
+			current[thread.PID] = []uint64{stat.RunningNanoseconds, stat.WaitingNanoseconds, stat.RunTimeslices}
+		}
+		sums := totals.update(current)
+		logData := fmt.Sprintf("%d,%d,%d,%d\n", evTime, sums[0], sums[1], sums[2])
+		tracer.writer.WriteString(logData)
+		return evTime
+	}
+}
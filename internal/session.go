@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"ogomon/pkg"
+
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const (
+	SESSION_FILE = "records/session"
+	EVENTS_FILE  = "records/events"
+)
+
+// Session holds what ogomon learned about the target over a whole run. The
+// metadata is rewritten to records/session on every change and notable events
+// are appended to records/events as "ts,event,detail" lines.
+//
+// Every incarnation of the target is a generation, numbered from 1. Metadata
+// about a single incarnation is stored under "generation.<n>.<key>".
+type Session struct {
+	mu         sync.Mutex
+	metadata   map[string]string
+	eventFile  *os.File
+	generation int
+}
+
+func NewSession(appendFile bool) (*Session, error) {
+	var eventFile *os.File
+	var err error
+	if !appendFile {
+		eventFile, err = os.Create(EVENTS_FILE)
+	} else {
+		eventFile, err = os.OpenFile(EVENTS_FILE, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Session{metadata: make(map[string]string), eventFile: eventFile}, nil
+}
+
+// Set records a metadata value and persists the metadata file.
+func (session *Session) Set(key string, value interface{}) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.metadata[key] = fmt.Sprint(value)
+	session.writeMetadata()
+}
+
+func (session *Session) Get(key string) string {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.metadata[key]
+}
+
+func (session *Session) writeMetadata() {
+	keys := make([]string, 0, len(session.metadata))
+	for k := range session.metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	f, err := os.Create(SESSION_FILE)
+	if err != nil {
+		jww.ERROR.Println(err)
+		return
+	}
+	defer f.Close()
+	for _, k := range keys {
+		fmt.Fprintf(f, "%s=%s\n", k, session.metadata[k])
+	}
+}
+
+// LogEvent appends an event to the session event log.
+func (session *Session) LogEvent(event string, format string, args ...interface{}) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	detail := fmt.Sprintf(format, args...)
+	if _, err := fmt.Fprintf(session.eventFile, "%d,%s,%s\n", GetEventTime(), event, detail); err != nil {
+		jww.ERROR.Println(err)
+	}
+	session.eventFile.Sync()
+}
+
+// NewGeneration starts the next incarnation of the target. Record files opened
+// afterwards are tagged with it.
+func (session *Session) NewGeneration(pid int) int {
+	session.mu.Lock()
+	session.generation++
+	gen := session.generation
+	session.mu.Unlock()
+
+	pkg.SetGeneration(gen, pid)
+	session.Set("generation", gen)
+	session.SetGeneration("pid", pid)
+	session.SetGeneration("start_time", GetEventTime())
+	if gen == 1 {
+		session.LogEvent("start", "generation=%d pid=%d", gen, pid)
+	} else {
+		session.LogEvent("restart", "generation=%d pid=%d", gen, pid)
+	}
+	return gen
+}
+
+func (session *Session) Generation() int {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.generation
+}
+
+// SetGeneration records a metadata value of the current generation.
+func (session *Session) SetGeneration(key string, value interface{}) {
+	session.Set(fmt.Sprintf("generation.%d.%s", session.Generation(), key), value)
+}
+
+// RecordExit stores how the current generation of the target ended.
+func (session *Session) RecordExit(exit pkg.ProcessExit) {
+	session.SetGeneration("exit_time", exit.Time.UnixNano())
+	if exit.Known {
+		session.SetGeneration("exit_status", exit.Status)
+		session.SetGeneration("exit_signal", int(exit.Signal))
+	}
+	session.LogEvent("exit", "generation=%d %s", session.Generation(), exit)
+}
+
+func (session *Session) Close() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.eventFile.Close()
+}
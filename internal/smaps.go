@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"ogomon/pkg"
+
+	"github.com/prometheus/procfs"
+)
+
+const (
+	SMAPS_TICKER_TIME = time.Second
+)
+
+// smapsRollupFields are the /proc/<pid>/smaps_rollup entries recorded by the
+// smaps tracer, in output column order.
+var smapsRollupFields = []string{
+	"Rss", "Pss", "Pss_Anon", "Pss_File", "Pss_Shmem",
+	"Shared_Clean", "Shared_Dirty", "Private_Clean", "Private_Dirty",
+	"Swap", "SwapPss", "AnonHugePages",
+}
+
+// readSmapsRollup returns the smaps_rollup entries of pid in bytes. Entries the
+// kernel does not provide are left out.
+func readSmapsRollup(pid int) (map[string]uint64, error) {
+	f, err := os.Open(filepath.Join(procfs.DefaultMountPoint, strconv.Itoa(pid), "smaps_rollup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]uint64, len(smapsRollupFields))
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		kB, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = kB * 1024
+	}
+	return values, scanner.Err()
+}
+
+// NewSmapsRollupTracer records the memory breakdown of smaps_rollup every
+// tickerTime. Reading it walks every mapping of the target, so it should run
+// much slower than the other memory tracers.
+func NewSmapsRollupTracer(proc *procfs.Proc, tickerTime time.Duration, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/smaps_rollup", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickSmapsRollup, writer: writer, tickerTime: tickerTime}, nil
+}
+
+func tickSmapsRollup(tracer *SystemTracer) uint64 {
+	evTime := GetEventTime()
+	values, _ := readSmapsRollup(tracer.proc.PID)
+	var logData strings.Builder
+	logData.WriteString(strconv.FormatUint(evTime, 10))
+	for _, field := range smapsRollupFields {
+		logData.WriteByte(',')
+		logData.WriteString(strconv.FormatUint(values[field], 10))
+	}
+	logData.WriteByte('\n')
+	tracer.writer.WriteString(logData.String())
+	return evTime
+}
+
+// WriteSmapsSnapshot copies the full per-mapping /proc/<pid>/smaps of proc to
+// records/smaps_<ts> and returns the file name.
+func WriteSmapsSnapshot(proc *procfs.Proc) (string, error) {
+	src, err := os.Open(filepath.Join(procfs.DefaultMountPoint, strconv.Itoa(proc.PID), "smaps"))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	filename := fmt.Sprintf("records/smaps_%d", GetEventTime())
+	dst, err := pkg.OpenRecordFile(filename, false)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
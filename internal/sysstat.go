@@ -6,6 +6,8 @@ import (
 	"os"
 	"time"
 
+	"ogomon/pkg"
+
 	"github.com/prometheus/procfs"
 )
 
@@ -18,147 +20,172 @@ const (
 type DataTicker func(tracer *SystemTracer) uint64
 
 type SystemTracer struct {
-	proc         *procfs.Proc
-	fs           *procfs.FS
-	ticker       DataTicker
-	tickerTime   time.Duration
-	logFile      *os.File
-	writer       *bufio.Writer
+	proc       *procfs.Proc
+	fs         *procfs.FS
+	ticker     DataTicker
+	tickerTime time.Duration
+	logFile    *os.File
+	writer     *bufio.Writer
+	// Further records the ticker writes, flushed and closed with logFile.
+	extraFiles   []*os.File
+	extraWriters []*bufio.Writer
 	isStop       bool
 }
 
 func NewMemAvaibaleTracer(fs *procfs.FS, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/memavailable")
-	} else {
-		logFile, _ = os.OpenFile("records/memavailable", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/memavailable", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 16384)
 	return &SystemTracer{fs: fs, ticker: tickMemAvailable, writer: writer, tickerTime: SYS_STAT_TICKER_TIME, logFile: logFile}, nil
 }
 
+// NewNetTCPV6Tracer records the tx queue length of every IPv6 TCP socket on the
+// host, see NewProcTCPQueueTracer for the target's own sockets.
 func NewNetTCPV6Tracer(fs *procfs.FS, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/TXQ6")
-	} else {
-		logFile, _ = os.OpenFile("records/TXQ6", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/TXQ6", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 16384)
 	return &SystemTracer{fs: fs, ticker: tickTXQueueV6, writer: writer, tickerTime: SYS_STAT_TICKER_TIME, logFile: logFile}, nil
 }
 
+// NewNetTCPTracer records the tx queue length of every IPv4 TCP socket on the
+// host, see NewProcTCPQueueTracer for the target's own sockets.
 func NewNetTCPTracer(fs *procfs.FS, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/TXQ")
-	} else {
-		logFile, _ = os.OpenFile("records/TXQ", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/TXQ", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 16384)
 	return &SystemTracer{fs: fs, ticker: tickTXQueue, writer: writer, tickerTime: SYS_STAT_TICKER_TIME, logFile: logFile}, nil
 }
 
-func NewDiskReadTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/disk_read")
-	} else {
-		logFile, _ = os.OpenFile("records/disk_read", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// NewIOTracer records every counter of /proc/<pid>/io from a single read per
+// tick: rchar, wchar, syscr, syscw, read_bytes, write_bytes and
+// cancelled_write_bytes. read_bytes and write_bytes also go alone to
+// records/disk_read and records/disk_write, as before records/io existed.
+func NewIOTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	var files []*os.File
+	for _, name := range []string{"records/io", "records/disk_read", "records/disk_write"} {
+		logFile, err := pkg.OpenRecordFile(name, appendFile)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, logFile)
 	}
-	writer := bufio.NewWriterSize(logFile, 8192)
-	return &SystemTracer{proc: proc, ticker: tickDiskRead, writer: writer, tickerTime: SYS_STAT_TICKER_TIME, logFile: logFile}, nil
-}
-
-func NewDiskWriteTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/disk_write")
-	} else {
-		logFile, _ = os.OpenFile("records/disk_write", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	tracer := &SystemTracer{proc: proc, logFile: files[0], ticker: tickIO, writer: bufio.NewWriterSize(files[0], 8192), tickerTime: SYS_STAT_TICKER_TIME}
+	for _, f := range files[1:] {
+		tracer.extraFiles = append(tracer.extraFiles, f)
+		tracer.extraWriters = append(tracer.extraWriters, bufio.NewWriterSize(f, 8192))
 	}
-	writer := bufio.NewWriterSize(logFile, 8192)
-	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickDiskWrite, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
+	return tracer, nil
 }
 
 func NewMemoryTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/memory")
-	} else {
-		logFile, _ = os.OpenFile("records/memory", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/memory", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 8192)
 	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickVirtualMemory, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
 }
 
 func NewResidentMemoryTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/rss_memory")
-	} else {
-		logFile, _ = os.OpenFile("records/rss_memory", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/rss_memory", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 8192)
 	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickResidentMemory, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
 }
 
 func NewDataVirtualMemoryTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/data_memory")
-	} else {
-		logFile, _ = os.OpenFile("records/data_memory", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/data_memory", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 8192)
 	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickDataVirtualMemory, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
 }
 
 func NewSTimeTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/s_time")
-	} else {
-		logFile, _ = os.OpenFile("records/s_time", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/s_time", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 8192)
 	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickSTime, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
 }
 
 func NewUTimeTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/u_time")
-	} else {
-		logFile, _ = os.OpenFile("records/u_time", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/u_time", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 8192)
 	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickUTime, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
 }
 
 func NewCSTimeTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/cs_time")
-	} else {
-		logFile, _ = os.OpenFile("records/cs_time", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/cs_time", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 8192)
 	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickCSTime, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
 }
 
 func NewCUTimeTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
-	var logFile *os.File
-	if !appendFile {
-		logFile, _ = os.Create("records/cu_time")
-	} else {
-		logFile, _ = os.OpenFile("records/cu_time", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := pkg.OpenRecordFile("records/cu_time", appendFile)
+	if err != nil {
+		return nil, err
 	}
 	writer := bufio.NewWriterSize(logFile, 8192)
 	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickCUTime, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
 }
 
+func NewMinorFaultTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/minor_faults", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickMinorFault, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
+}
+
+func NewMajorFaultTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/major_faults", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickMajorFault, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
+}
+
+func NewCMinorFaultTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/cminor_faults", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickCMinorFault, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
+}
+
+func NewCMajorFaultTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/cmajor_faults", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 8192)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: tickCMajorFault, writer: writer, tickerTime: SYS_STAT_TICKER_TIME}, nil
+}
+
 func tickMemAvailable(tracer *SystemTracer) uint64 {
 	evTime := GetEventTime()
 	stat, _ := tracer.fs.Meminfo()
@@ -168,21 +195,18 @@ func tickMemAvailable(tracer *SystemTracer) uint64 {
 	return evTime
 }
 
-func tickDiskRead(tracer *SystemTracer) uint64 {
-	evTime := GetEventTime()
-	stat, _ := tracer.proc.IO()
-	readBytes := stat.ReadBytes
-	logData := fmt.Sprintf("%d,%d\n", evTime, readBytes)
-	tracer.writer.WriteString(logData)
-	return evTime
-}
-
-func tickDiskWrite(tracer *SystemTracer) uint64 {
+func tickIO(tracer *SystemTracer) uint64 {
 	evTime := GetEventTime()
 	stat, _ := tracer.proc.IO()
-	writeBytes := stat.WriteBytes
-	logData := fmt.Sprintf("%d,%d\n", evTime, writeBytes)
+	logData := fmt.Sprintf(
+		"%d,%d,%d,%d,%d,%d,%d,%d\n",
+		evTime,
+		stat.RChar, stat.WChar, stat.SyscR, stat.SyscW,
+		stat.ReadBytes, stat.WriteBytes, stat.CancelledWriteBytes,
+	)
 	tracer.writer.WriteString(logData)
+	tracer.extraWriters[0].WriteString(fmt.Sprintf("%d,%d\n", evTime, stat.ReadBytes))
+	tracer.extraWriters[1].WriteString(fmt.Sprintf("%d,%d\n", evTime, stat.WriteBytes))
 	return evTime
 }
 
@@ -249,6 +273,42 @@ func tickUTime(tracer *SystemTracer) uint64 {
 	return evTime
 }
 
+func tickMinorFault(tracer *SystemTracer) uint64 {
+	evTime := GetEventTime()
+	stat, _ := tracer.proc.Stat()
+	recordedMinFlt := uint64(stat.MinFlt)
+	logData := fmt.Sprintf("%d,%d\n", evTime, recordedMinFlt)
+	tracer.writer.WriteString(logData)
+	return evTime
+}
+
+func tickMajorFault(tracer *SystemTracer) uint64 {
+	evTime := GetEventTime()
+	stat, _ := tracer.proc.Stat()
+	recordedMajFlt := uint64(stat.MajFlt)
+	logData := fmt.Sprintf("%d,%d\n", evTime, recordedMajFlt)
+	tracer.writer.WriteString(logData)
+	return evTime
+}
+
+func tickCMinorFault(tracer *SystemTracer) uint64 {
+	evTime := GetEventTime()
+	stat, _ := tracer.proc.Stat()
+	recordedCMinFlt := uint64(stat.CMinFlt)
+	logData := fmt.Sprintf("%d,%d\n", evTime, recordedCMinFlt)
+	tracer.writer.WriteString(logData)
+	return evTime
+}
+
+func tickCMajorFault(tracer *SystemTracer) uint64 {
+	evTime := GetEventTime()
+	stat, _ := tracer.proc.Stat()
+	recordedCMajFlt := uint64(stat.CMajFlt)
+	logData := fmt.Sprintf("%d,%d\n", evTime, recordedCMajFlt)
+	tracer.writer.WriteString(logData)
+	return evTime
+}
+
 func tickTXQueue(tracer *SystemTracer) uint64 {
 	evTime := GetEventTime()
 	summary, _ := tracer.fs.NetTCPSummary()
@@ -276,8 +336,11 @@ func (systemTracer *SystemTracer) Start() {
 			systemTracer.TearDown()
 			break
 		}
-		d := (uint64(time.Now().UnixNano()) - t1) / 1000
-		time.Sleep(time.Duration(SYS_STAT_STEP - d) * time.Microsecond)
+		// Ticks slower than the step start the next one right away.
+		d := time.Duration(uint64(time.Now().UnixNano()) - t1)
+		if d < systemTracer.tickerTime {
+			time.Sleep(systemTracer.tickerTime - d)
+		}
 	}
 }
 
@@ -288,6 +351,10 @@ func (systemTracer SystemTracer) GetTickerTime() time.Duration {
 func (systemTracer *SystemTracer) TearDown() {
 	systemTracer.writer.Flush()
 	systemTracer.logFile.Close()
+	for idx, writer := range systemTracer.extraWriters {
+		writer.Flush()
+		systemTracer.extraFiles[idx].Close()
+	}
 }
 
 func (systemTracer *SystemTracer) Stop() {
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"ogomon/pkg"
+
+	"github.com/prometheus/procfs"
+)
+
+const (
+	PROC_TCP_QUEUE_TICKER_TIME = 100 * time.Millisecond
+	PROC_TCP_CONN_TICKER_TIME  = 100 * time.Millisecond
+	// Listing the descriptors of the target costs more than reading the
+	// tables, sockets opened since the last listing are missed until the next.
+	PROC_TCP_INODE_REFRESH_TIME = time.Second
+)
+
+// procTCPSocketReader keeps the socket inodes of the target between ticks.
+type procTCPSocketReader struct {
+	inodes    map[uint64]bool
+	refreshed time.Time
+}
+
+// sockets returns the IPv4 and IPv6 TCP sockets owned by proc. The tables are
+// read from /proc/<pid>/net so they belong to the target's network namespace.
+func (reader *procTCPSocketReader) sockets(proc *procfs.Proc) procfs.NetTCP {
+	if time.Since(reader.refreshed) >= PROC_TCP_INODE_REFRESH_TIME {
+		reader.inodes = pkg.SocketInodes(proc)
+		reader.refreshed = time.Now()
+	}
+	inodes := reader.inodes
+	if len(inodes) == 0 {
+		return nil
+	}
+	fs, err := procfs.NewFS(filepath.Join(procfs.DefaultMountPoint, strconv.Itoa(proc.PID)))
+	if err != nil {
+		return nil
+	}
+	var sockets procfs.NetTCP
+	tcp, _ := fs.NetTCP()
+	tcp6, _ := fs.NetTCP6()
+	for _, table := range []procfs.NetTCP{tcp, tcp6} {
+		for _, line := range table {
+			if inodes[line.Inode] {
+				sockets = append(sockets, line)
+			}
+		}
+	}
+	return sockets
+}
+
+// NewProcTCPQueueTracer records the tx and rx queue lengths summed over the TCP
+// sockets of the target, unlike the TXQ tracers which cover the whole host.
+func NewProcTCPQueueTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/proc_txq", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 16384)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newProcTCPQueueTicker(), writer: writer, tickerTime: PROC_TCP_QUEUE_TICKER_TIME}, nil
+}
+
+// NewProcTCPConnectionTracer records the tx and rx queue lengths of every TCP
+// connection of the target, one line per connection and tick.
+func NewProcTCPConnectionTracer(proc *procfs.Proc, appendFile bool) (*SystemTracer, error) {
+	logFile, err := pkg.OpenRecordFile("records/proc_tcp_conns", appendFile)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(logFile, 16384)
+	return &SystemTracer{proc: proc, logFile: logFile, ticker: newProcTCPConnectionTicker(), writer: writer, tickerTime: PROC_TCP_CONN_TICKER_TIME}, nil
+}
+
+func newProcTCPQueueTicker() DataTicker {
+	reader := &procTCPSocketReader{}
+	return func(tracer *SystemTracer) uint64 {
+		return tickProcTCPQueue(tracer, reader)
+	}
+}
+
+func newProcTCPConnectionTicker() DataTicker {
+	reader := &procTCPSocketReader{}
+	return func(tracer *SystemTracer) uint64 {
+		return tickProcTCPConnections(tracer, reader)
+	}
+}
+
+func tickProcTCPQueue(tracer *SystemTracer, reader *procTCPSocketReader) uint64 {
+	evTime := GetEventTime()
+	sockets := reader.sockets(tracer.proc)
+	var txQueue, rxQueue uint64
+	for _, socket := range sockets {
+		txQueue += socket.TxQueue
+		rxQueue += socket.RxQueue
+	}
+	logData := fmt.Sprintf("%d,%d,%d,%d\n", evTime, txQueue, rxQueue, len(sockets))
+	tracer.writer.WriteString(logData)
+	return evTime
+}
+
+func tickProcTCPConnections(tracer *SystemTracer, reader *procTCPSocketReader) uint64 {
+	evTime := GetEventTime()
+	for _, socket := range reader.sockets(tracer.proc) {
+		logData := fmt.Sprintf(
+			"%d,%s,%d,%s,%d,%d,%d,%d\n",
+			evTime,
+			socket.LocalAddr, socket.LocalPort,
+			socket.RemAddr, socket.RemPort,
+			socket.St, socket.TxQueue, socket.RxQueue,
+		)
+		tracer.writer.WriteString(logData)
+	}
+	return evTime
+}
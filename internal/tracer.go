@@ -1,6 +1,9 @@
 package internal
 
-import "time"
+import (
+	"net"
+	"time"
+)
 
 type Tracer interface {
 	Start()
@@ -16,7 +19,8 @@ type NetworkTrace struct {
 	Len       uint64
 	Sport     uint64
 	Dport     uint64
-	Saddr     uint64
-	Daddr     uint64
+	Saddr     net.IP
+	Daddr     net.IP
 	Direction uint64
+	Protocol  uint64
 }
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+
+	procfs "github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
+)
+
+// CgroupV2Mount returns where the cgroup v2 hierarchy is mounted in ogomon's
+// mount namespace.
+func CgroupV2Mount() (string, error) {
+	self, err := procfs.Self()
+	if err != nil {
+		return "", err
+	}
+	mounts, err := self.MountInfo()
+	if err != nil {
+		return "", err
+	}
+	for _, mount := range mounts {
+		if mount.FSType == "cgroup2" {
+			return mount.MountPoint, nil
+		}
+	}
+	return "", fmt.Errorf("cgroup v2 is not mounted")
+}
+
+// CgroupV2Path returns the cgroup v2 directory proc belongs to.
+func CgroupV2Path(proc procfs.Proc) (string, error) {
+	mountPoint, err := CgroupV2Mount()
+	if err != nil {
+		return "", err
+	}
+	cgroups, err := proc.Cgroups()
+	if err != nil {
+		return "", err
+	}
+	for _, cgroup := range cgroups {
+		if cgroup.HierarchyID == 0 && len(cgroup.Controllers) == 0 {
+			return filepath.Join(mountPoint, cgroup.Path), nil
+		}
+	}
+	return "", fmt.Errorf("process %d is not in a cgroup v2", proc.PID)
+}
+
+// CgroupV2ID returns the id of proc's cgroup v2, the inode number of its
+// directory, which bpf_skb_cgroup_id reports for its sockets.
+func CgroupV2ID(proc procfs.Proc) (uint64, error) {
+	path, err := CgroupV2Path(proc)
+	if err != nil {
+		return 0, err
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Ino, nil
+}
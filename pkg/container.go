@@ -0,0 +1,177 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	procfs "github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
+)
+
+// containerScopePrefixes are the unit name prefixes used by docker, containerd,
+// cri-o and podman when they place a container in a systemd scope.
+var containerScopePrefixes = []string{"docker-", "cri-containerd-", "crio-", "libpod-"}
+
+// containerIDFromCgroupPath returns the container id found in one path segment of
+// a /proc/<pid>/cgroup entry, or "" if the segment does not name a container.
+func containerIDFromCgroupPath(segment string) string {
+	segment = strings.TrimSuffix(segment, ".scope")
+	// conmon runs in a sibling scope named after the container, it is not part of it.
+	if strings.Contains(segment, "conmon") {
+		return ""
+	}
+	for _, prefix := range containerScopePrefixes {
+		if strings.HasPrefix(segment, prefix) {
+			segment = strings.TrimPrefix(segment, prefix)
+			break
+		}
+	}
+	if len(segment) != 64 {
+		return ""
+	}
+	for _, c := range segment {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+	return segment
+}
+
+// procContainerID returns the full id of the container proc runs in when it
+// starts with containerID, or "" otherwise.
+func procContainerID(proc procfs.Proc, containerID string) string {
+	cgroups, err := proc.Cgroups()
+	if err != nil {
+		return ""
+	}
+	for _, cgroup := range cgroups {
+		for _, segment := range strings.Split(cgroup.Path, "/") {
+			id := containerIDFromCgroupPath(segment)
+			if id != "" && strings.HasPrefix(id, containerID) {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// procInContainer reports whether any cgroup of proc belongs to the container
+// whose id starts with containerID.
+func procInContainer(proc procfs.Proc, containerID string) bool {
+	return procContainerID(proc, containerID) != ""
+}
+
+// GetContainerProcs returns every live process under procRoot that runs inside
+// the container identified by containerID, which may be a full id or a prefix
+// of one. A prefix of several running containers' ids is an error.
+func GetContainerProcs(procRoot string, containerID string) (procfs.Procs, error) {
+	containerID = strings.ToLower(containerID)
+	if containerID == "" {
+		return nil, fmt.Errorf("empty container id")
+	}
+	fs, err := procfs.NewFS(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	procs, err := fs.AllProcs()
+	if err != nil {
+		return nil, err
+	}
+	var containerProcs procfs.Procs
+	ids := make(map[string]bool)
+	for _, p := range procs {
+		id := procContainerID(p, containerID)
+		if id != "" && procAlive(p) {
+			containerProcs = append(containerProcs, p)
+			ids[id] = true
+		}
+	}
+	if len(containerProcs) == 0 {
+		return nil, fmt.Errorf("no process found for container %s", containerID)
+	}
+	if len(ids) > 1 {
+		var matching []string
+		for id := range ids {
+			matching = append(matching, id)
+		}
+		sort.Strings(matching)
+		return nil, fmt.Errorf("container id %s is ambiguous, it matches %s", containerID, strings.Join(matching, ", "))
+	}
+	return containerProcs, nil
+}
+
+// GetContainerProc picks the process to monitor inside a container. When name is
+// set the first process whose command line contains it is used, otherwise the
+// main process of the container, the one whose parent lives outside of it.
+func GetContainerProc(procRoot string, containerID string, name string) (procfs.Proc, error) {
+	procs, err := GetContainerProcs(procRoot, containerID)
+	if err != nil {
+		return procfs.Proc{}, err
+	}
+	if name != "" {
+		for _, p := range procs {
+			cmdParts, _ := p.CmdLine()
+			for _, cmdPart := range cmdParts {
+				if strings.Contains(cmdPart, name) {
+					return p, nil
+				}
+			}
+		}
+		return procfs.Proc{}, fmt.Errorf("no process matching %s in container %s", name, containerID)
+	}
+	members := make(map[int]bool, len(procs))
+	for _, p := range procs {
+		members[p.PID] = true
+	}
+	for _, p := range procs {
+		stat, err := p.Stat()
+		if err != nil {
+			continue
+		}
+		if !members[stat.PPID] {
+			return p, nil
+		}
+	}
+	return procs[0], nil
+}
+
+// NetNSPath returns the network namespace file of pid under procRoot.
+func NetNSPath(procRoot string, pid int) string {
+	return filepath.Join(procRoot, strconv.Itoa(pid), "ns", "net")
+}
+
+// RunInNetNS runs fn with the calling thread moved into the network namespace at
+// nsPath. Sockets created by fn stay bound to that namespace after it returns.
+func RunInNetNS(nsPath string, fn func() error) error {
+	runtime.LockOSThread()
+
+	origin, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	target, err := os.Open(nsPath)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("entering network namespace %s: %w", nsPath, err)
+	}
+	fnErr := fn()
+	if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+		// Leave the thread locked so it is destroyed instead of reused in the wrong namespace.
+		return fmt.Errorf("leaving network namespace %s: %w", nsPath, err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
@@ -0,0 +1,320 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	procfs "github.com/prometheus/procfs"
+)
+
+const (
+	testContainerID  = "4f1c9a0e6b2d7c8e3a5f0b1d2c3e4f5a6b7c8d9e0f1a2b3c4d5e6f708192a3b4"
+	otherContainerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+type fakeProc struct {
+	pid     int
+	ppid    int
+	state   string
+	cgroup  string
+	cmdline []string
+	nsPids  []int
+	pidNS   string
+}
+
+// writeFakeProcRoot lays procs out like /proc under a temporary directory. The
+// pid namespace files are hard links to files named after pidNS, so processes
+// in the same namespace share the inode like they do on nsfs.
+func writeFakeProcRoot(t *testing.T, procs []fakeProc) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, p := range procs {
+		dir := filepath.Join(root, strconv.Itoa(p.pid))
+		if err := os.MkdirAll(filepath.Join(dir, "ns"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		fields := make([]string, 40)
+		for idx := range fields {
+			fields[idx] = "0"
+		}
+		stat := fmt.Sprintf("%d (%s) %s %d %s\n", p.pid, filepath.Base(p.cmdline[0]), p.state, p.ppid, strings.Join(fields, " "))
+		var nsPids []string
+		for _, nsPid := range p.nsPids {
+			nsPids = append(nsPids, strconv.Itoa(nsPid))
+		}
+		status := fmt.Sprintf("Name:\t%s\nPid:\t%d\nNSpid:\t%s\n", filepath.Base(p.cmdline[0]), p.pid, strings.Join(nsPids, "\t"))
+		files := map[string]string{
+			"stat":    stat,
+			"status":  status,
+			"cgroup":  p.cgroup + "\n",
+			"cmdline": strings.Join(p.cmdline, "\x00") + "\x00",
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		nsFile := filepath.Join(root, "pidns-"+p.pidNS)
+		if _, err := os.Stat(nsFile); os.IsNotExist(err) {
+			if err := os.WriteFile(nsFile, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Link(nsFile, PidNSPath(root, p.pid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// testProcs is a host running a docker container whose main process 100 has a
+// worker child and an unreaped zombie, next to podman's conmon monitoring the
+// same id from its own scope and a process of another container.
+var testProcs = []fakeProc{
+	{pid: 1, ppid: 0, state: "S", cgroup: "0::/init.scope", cmdline: []string{"/sbin/init"}, nsPids: []int{1}, pidNS: "host"},
+	{pid: 90, ppid: 1, state: "S", cgroup: "0::/system.slice/containerd.service", cmdline: []string{"containerd-shim-runc-v2"}, nsPids: []int{90}, pidNS: "host"},
+	{pid: 95, ppid: 1, state: "S", cgroup: "0::/machine.slice/libpod-conmon-" + testContainerID + ".scope", cmdline: []string{"/usr/bin/conmon", "--cid", testContainerID}, nsPids: []int{95}, pidNS: "host"},
+	{pid: 100, ppid: 90, state: "S", cgroup: "0::/system.slice/docker-" + testContainerID + ".scope", cmdline: []string{"/app/server", "--port", "80"}, nsPids: []int{100, 1}, pidNS: "app"},
+	{pid: 101, ppid: 100, state: "R", cgroup: "0::/system.slice/docker-" + testContainerID + ".scope", cmdline: []string{"/app/worker"}, nsPids: []int{101, 7}, pidNS: "app"},
+	{pid: 102, ppid: 100, state: "Z", cgroup: "0::/system.slice/docker-" + testContainerID + ".scope", cmdline: []string{"/app/worker"}, nsPids: []int{102, 8}, pidNS: "app"},
+	{pid: 200, ppid: 90, state: "S", cgroup: "0::/kubepods.slice/cri-containerd-" + otherContainerID + ".scope", cmdline: []string{"/bin/worker"}, nsPids: []int{200, 1}, pidNS: "other"},
+}
+
+func TestContainerIDFromCgroupPath(t *testing.T) {
+	tests := []struct {
+		segment string
+		want    string
+	}{
+		{"docker-" + testContainerID + ".scope", testContainerID},
+		{"cri-containerd-" + testContainerID + ".scope", testContainerID},
+		{"crio-" + testContainerID + ".scope", testContainerID},
+		{"libpod-" + testContainerID + ".scope", testContainerID},
+		{"libpod-conmon-" + testContainerID + ".scope", ""},
+		{"crio-conmon-" + testContainerID + ".scope", ""},
+		// cgroupfs driver, /docker/<id>
+		{testContainerID, testContainerID},
+		{"docker.service", ""},
+		{"docker-" + testContainerID[:12] + ".scope", ""},
+		{"docker-" + strings.ToUpper(testContainerID) + ".scope", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := containerIDFromCgroupPath(test.segment); got != test.want {
+			t.Errorf("containerIDFromCgroupPath(%q) = %q, want %q", test.segment, got, test.want)
+		}
+	}
+}
+
+func TestGetContainerProcs(t *testing.T) {
+	root := writeFakeProcRoot(t, testProcs)
+	procs, err := GetContainerProcs(root, testContainerID[:12])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pids []int
+	for _, p := range procs {
+		pids = append(pids, p.PID)
+	}
+	if fmt.Sprint(pids) != "[100 101]" {
+		t.Errorf("GetContainerProcs = %v, want [100 101] without conmon and the zombie", pids)
+	}
+	if _, err := GetContainerProcs(root, "feedface"); err == nil {
+		t.Error("GetContainerProcs of an unknown container succeeded")
+	}
+}
+
+func TestGetContainerProcsAmbiguous(t *testing.T) {
+	twinID := testContainerID[:12] + strings.Repeat("a", 52)
+	procs := append(testProcs[:len(testProcs):len(testProcs)], fakeProc{
+		pid: 300, ppid: 90, state: "S", cgroup: "0::/system.slice/docker-" + twinID + ".scope", cmdline: []string{"/bin/twin"}, nsPids: []int{300, 1}, pidNS: "twin",
+	})
+	root := writeFakeProcRoot(t, procs)
+	if got, err := GetContainerProcs(root, testContainerID[:12]); err == nil {
+		t.Errorf("GetContainerProcs of a prefix of two containers returned %d processes", len(got))
+	}
+	if _, err := GetContainerProc(root, testContainerID[:12], "worker"); err == nil {
+		t.Error("GetContainerProc of a prefix of two containers succeeded")
+	}
+	tests := []struct {
+		containerID string
+		want        string
+	}{
+		{testContainerID[:13], "[100 101]"},
+		{twinID[:13], "[300]"},
+		{twinID, "[300]"},
+	}
+	for _, test := range tests {
+		procs, err := GetContainerProcs(root, test.containerID)
+		if err != nil {
+			t.Errorf("GetContainerProcs(%q): %v", test.containerID, err)
+			continue
+		}
+		var pids []int
+		for _, p := range procs {
+			pids = append(pids, p.PID)
+		}
+		if fmt.Sprint(pids) != test.want {
+			t.Errorf("GetContainerProcs(%q) = %v, want %s", test.containerID, pids, test.want)
+		}
+	}
+}
+
+func TestGetContainerProc(t *testing.T) {
+	root := writeFakeProcRoot(t, testProcs)
+	tests := []struct {
+		containerID string
+		name        string
+		want        int
+	}{
+		{testContainerID, "", 100},
+		{strings.ToUpper(testContainerID[:12]), "", 100},
+		{testContainerID, "worker", 101},
+		{testContainerID, "server", 100},
+		{otherContainerID, "", 200},
+	}
+	for _, test := range tests {
+		proc, err := GetContainerProc(root, test.containerID, test.name)
+		if err != nil {
+			t.Errorf("GetContainerProc(%q, %q): %v", test.containerID, test.name, err)
+			continue
+		}
+		if proc.PID != test.want {
+			t.Errorf("GetContainerProc(%q, %q) = %d, want %d", test.containerID, test.name, proc.PID, test.want)
+		}
+	}
+	if _, err := GetContainerProc(root, testContainerID, "nginx"); err == nil {
+		t.Error("GetContainerProc found a process for a name no process has")
+	}
+}
+
+func TestTranslateNSPid(t *testing.T) {
+	root := writeFakeProcRoot(t, testProcs)
+	appNS := filepath.Join(root, "pidns-app")
+	otherNS := filepath.Join(root, "pidns-other")
+	tests := []struct {
+		nsPath string
+		nsPid  int
+		want   int
+	}{
+		{appNS, 1, 100},
+		{appNS, 7, 101},
+		{otherNS, 1, 200},
+		{appNS, 9, -1},
+		{otherNS, 7, -1},
+		{filepath.Join(root, "pidns-missing"), 1, -1},
+	}
+	for _, test := range tests {
+		proc, err := TranslateNSPid(root, test.nsPath, test.nsPid)
+		if test.want == -1 {
+			if err == nil {
+				t.Errorf("TranslateNSPid(%s, %d) = %d, want an error", filepath.Base(test.nsPath), test.nsPid, proc.PID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TranslateNSPid(%s, %d): %v", filepath.Base(test.nsPath), test.nsPid, err)
+			continue
+		}
+		if proc.PID != test.want {
+			t.Errorf("TranslateNSPid(%s, %d) = %d, want %d", filepath.Base(test.nsPath), test.nsPid, proc.PID, test.want)
+		}
+	}
+}
+
+func TestTargetSpecFind(t *testing.T) {
+	root := writeFakeProcRoot(t, testProcs)
+	tests := []struct {
+		spec TargetSpec
+		want int
+	}{
+		{TargetSpec{PID: 101}, 101},
+		{TargetSpec{PID: 102}, -1},
+		{TargetSpec{Name: "server", PID: -1}, 100},
+		{TargetSpec{Name: "conmon", PID: -1}, 95},
+		{TargetSpec{ContainerID: testContainerID, PID: -1}, 100},
+		{TargetSpec{ContainerID: testContainerID, Name: "worker", PID: -1}, 101},
+		{TargetSpec{ContainerID: otherContainerID[:12], PID: -1}, 200},
+		{TargetSpec{ContainerID: "feedface", PID: -1}, -1},
+		{TargetSpec{ContainerID: testContainerID, PID: 7}, 101},
+		{TargetSpec{ContainerID: testContainerID, PID: 8}, -1},
+		{TargetSpec{ContainerID: testContainerID, PID: 9}, -1},
+		{TargetSpec{PIDNamespace: filepath.Join(root, "pidns-other"), PID: 1}, 200},
+	}
+	for _, test := range tests {
+		test.spec.ProcRoot = root
+		proc, err := test.spec.Find()
+		if test.want == -1 {
+			if err == nil {
+				t.Errorf("%+v found %d, want an error", test.spec, proc.PID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", test.spec, err)
+			continue
+		}
+		if proc.PID != test.want {
+			t.Errorf("%+v found %d, want %d", test.spec, proc.PID, test.want)
+		}
+	}
+}
+
+func TestTargetSpecMatches(t *testing.T) {
+	root := writeFakeProcRoot(t, testProcs)
+	fs, err := procfs.NewFS(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		spec TargetSpec
+		pid  int
+		want bool
+	}{
+		{TargetSpec{ContainerID: testContainerID[:12], PID: -1}, 101, true},
+		{TargetSpec{ContainerID: testContainerID[:12], PID: -1}, 95, false},
+		{TargetSpec{ContainerID: testContainerID[:12], PID: -1}, 200, false},
+		{TargetSpec{ContainerID: testContainerID, Name: "worker", PID: -1}, 101, true},
+		{TargetSpec{ContainerID: testContainerID, Name: "worker", PID: -1}, 100, false},
+		{TargetSpec{ContainerID: testContainerID, Name: "worker", PID: -1}, 102, false},
+		{TargetSpec{PID: 102}, 102, false},
+		{TargetSpec{PID: 100}, 100, true},
+		{TargetSpec{PID: 100}, 101, false},
+		{TargetSpec{Name: "containerd", PID: -1}, 90, true},
+		{TargetSpec{Name: "containerd", PID: -1}, 1, false},
+		{TargetSpec{ContainerID: testContainerID, PID: 7}, 101, true},
+		{TargetSpec{ContainerID: testContainerID, PID: 7}, 100, false},
+		{TargetSpec{ContainerID: testContainerID, PID: 7}, 200, false},
+		{TargetSpec{PIDNamespace: filepath.Join(root, "pidns-other"), PID: 1}, 200, true},
+		{TargetSpec{PIDNamespace: filepath.Join(root, "pidns-other"), PID: 1}, 100, false},
+	}
+	for _, test := range tests {
+		test.spec.ProcRoot = root
+		spec, err := test.spec.withPIDNamespace()
+		if err != nil {
+			t.Fatal(err)
+		}
+		proc, err := fs.Proc(test.pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := spec.Matches(proc); got != test.want {
+			t.Errorf("%+v matches %d = %v, want %v", test.spec, test.pid, got, test.want)
+		}
+	}
+
+	// Before the namespace is resolved any process of the container matches.
+	spec := TargetSpec{ContainerID: testContainerID, PID: 7, ProcRoot: root}
+	for pid, want := range map[int]bool{100: true, 101: true, 200: false} {
+		proc, err := fs.Proc(pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := spec.Matches(proc); got != want {
+			t.Errorf("unresolved %+v matches %d = %v, want %v", spec, pid, got, want)
+		}
+	}
+}
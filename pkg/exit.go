@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	procfs "github.com/prometheus/procfs"
+	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	EXIT_POLL_INTERVAL = 500 * time.Millisecond
+)
+
+// ProcessExit describes how a monitored process ended. Status and Signal are
+// only meaningful when Known is set: the exit status of a process that is not
+// our child can only be read while it is a zombie or from the proc connector.
+type ProcessExit struct {
+	PID    int
+	Time   time.Time
+	Known  bool
+	Status int
+	Signal syscall.Signal
+}
+
+func (exit ProcessExit) String() string {
+	if !exit.Known {
+		return fmt.Sprintf("pid=%d status=unknown", exit.PID)
+	}
+	if exit.Signal != 0 {
+		return fmt.Sprintf("pid=%d signal=%d (%s)", exit.PID, int(exit.Signal), exit.Signal)
+	}
+	return fmt.Sprintf("pid=%d status=%d", exit.PID, exit.Status)
+}
+
+func (exit *ProcessExit) setWaitStatus(code uint32) {
+	ws := syscall.WaitStatus(code)
+	exit.Known = true
+	if ws.Signaled() {
+		exit.Signal = ws.Signal()
+	} else {
+		exit.Status = ws.ExitStatus()
+	}
+}
+
+// WaitProcessExit blocks until pid exits. It waits on a pidfd when the kernel
+// supports pidfd_open, falls back to the netlink proc connector, and as a last
+// resort polls /proc at EXIT_POLL_INTERVAL.
+func WaitProcessExit(pid int) (ProcessExit, error) {
+	exit, err := waitPidfd(pid)
+	if err == nil {
+		return exit, nil
+	}
+	jww.WARN.Println("pidfd exit detection unavailable: ", err)
+	exit, err = waitProcConnector(pid)
+	if err == nil {
+		return exit, nil
+	}
+	jww.WARN.Println("proc connector exit detection unavailable: ", err)
+	return waitPolling(pid), nil
+}
+
+func waitPidfd(pid int) (ProcessExit, error) {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return ProcessExit{}, err
+	}
+	defer unix.Close(fd)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return ProcessExit{}, err
+		}
+		break
+	}
+	exit := ProcessExit{PID: pid, Time: time.Now()}
+	if code, err := zombieExitCode(pid); err == nil {
+		exit.setWaitStatus(code)
+	}
+	return exit, nil
+}
+
+func waitProcConnector(pid int) (ProcessExit, error) {
+	pc, err := NewProcConnector()
+	if err != nil {
+		return ProcessExit{}, err
+	}
+	defer pc.Close()
+	// The subscription is live now, so an exit cannot slip between this check and Receive.
+	if !processAlive(pid) {
+		return ProcessExit{PID: pid, Time: time.Now()}, nil
+	}
+	for {
+		events, err := pc.Receive()
+		if err != nil {
+			if errors.Is(err, unix.ENOBUFS) {
+				// Events were dropped, ours may be among them.
+				if !processAlive(pid) {
+					return ProcessExit{PID: pid, Time: time.Now()}, nil
+				}
+				continue
+			}
+			return ProcessExit{}, err
+		}
+		for _, ev := range events {
+			if ev.What == PROC_EVENT_EXIT && ev.PID == pid && ev.TGID == pid {
+				exit := ProcessExit{PID: pid, Time: ev.Time}
+				exit.setWaitStatus(ev.ExitCode)
+				return exit, nil
+			}
+		}
+	}
+}
+
+func waitPolling(pid int) ProcessExit {
+	for processAlive(pid) {
+		time.Sleep(EXIT_POLL_INTERVAL)
+	}
+	exit := ProcessExit{PID: pid, Time: time.Now()}
+	if code, err := zombieExitCode(pid); err == nil {
+		exit.setWaitStatus(code)
+	}
+	return exit
+}
+
+// processAlive reports whether pid exists and has not exited yet. Zombies are
+// considered dead.
+func processAlive(pid int) bool {
+	state, err := procState(pid)
+	return err == nil && liveState(state)
+}
+
+// procAlive is processAlive for a proc under any proc root. A zombie is still
+// listed until its parent reaps it, it must not be taken for the target again.
+func procAlive(proc procfs.Proc) bool {
+	stat, err := proc.Stat()
+	return err == nil && liveState(stat.State)
+}
+
+func liveState(state string) bool {
+	return state != "Z" && state != "X"
+}
+
+// zombieExitCode reads the exit_code field (52) of /proc/<pid>/stat, which the
+// kernel fills in once the process has exited and until its parent reaps it.
+func zombieExitCode(pid int) (uint32, error) {
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	if fields[0] != "Z" && fields[0] != "X" {
+		return 0, fmt.Errorf("process %d has not exited", pid)
+	}
+	// fields starts at the state, field 3 of the stat file.
+	if len(fields) < 50 {
+		return 0, fmt.Errorf("no exit code in /proc/%d/stat", pid)
+	}
+	code, err := strconv.ParseUint(fields[49], 10, 32)
+	return uint32(code), err
+}
+
+func procState(pid int) (string, error) {
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return "", err
+	}
+	return fields[0], nil
+}
+
+// procStatFields returns the fields of /proc/<pid>/stat after the command name.
+func procStatFields(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	stat := string(data)
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return nil, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return fields, nil
+}
@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	procfs "github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
+)
+
+// NSpids returns the NSpid line of /proc/<pid>/status: the pid of the process
+// in every pid namespace it is visible in, from the one procRoot belongs to down
+// to its own.
+func NSpids(procRoot string, pid int) ([]int, error) {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "NSpid:") {
+			continue
+		}
+		var pids []int
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "NSpid:")) {
+			p, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("malformed NSpid line %q: %w", line, err)
+			}
+			pids = append(pids, p)
+		}
+		if len(pids) == 0 {
+			break
+		}
+		return pids, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no NSpid in status of %d, kernel older than 4.1?", pid)
+}
+
+// PidNSPath returns the pid namespace file of pid under procRoot.
+func PidNSPath(procRoot string, pid int) string {
+	return filepath.Join(procRoot, strconv.Itoa(pid), "ns", "pid")
+}
+
+// namespaceID identifies the namespace nsPath refers to by the device and inode
+// of its nsfs file.
+func namespaceID(nsPath string) (uint64, uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(nsPath, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Dev, st.Ino, nil
+}
+
+func sameNamespace(a string, b string) bool {
+	aDev, aIno, err := namespaceID(a)
+	if err != nil {
+		return false
+	}
+	bDev, bIno, err := namespaceID(b)
+	if err != nil {
+		return false
+	}
+	return aDev == bDev && aIno == bIno
+}
+
+// procHasNSPid reports whether proc lives in the pid namespace at nsPath with
+// nsPid as its pid there.
+func procHasNSPid(procRoot string, proc procfs.Proc, nsPath string, nsPid int) bool {
+	pids, err := NSpids(procRoot, proc.PID)
+	if err != nil || pids[len(pids)-1] != nsPid {
+		return false
+	}
+	return sameNamespace(PidNSPath(procRoot, proc.PID), nsPath)
+}
+
+// TranslateNSPid finds the process known as nsPid inside the pid namespace at
+// nsPath and returns it as seen from procRoot.
+func TranslateNSPid(procRoot string, nsPath string, nsPid int) (procfs.Proc, error) {
+	if _, _, err := namespaceID(nsPath); err != nil {
+		return procfs.Proc{}, err
+	}
+	fs, err := procfs.NewFS(procRoot)
+	if err != nil {
+		return procfs.Proc{}, err
+	}
+	procs, err := fs.AllProcs()
+	if err != nil {
+		return procfs.Proc{}, err
+	}
+	for _, p := range procs {
+		if procHasNSPid(procRoot, p, nsPath, nsPid) {
+			return p, nil
+		}
+	}
+	return procfs.Proc{}, fmt.Errorf("no process with pid %d in namespace %s", nsPid, nsPath)
+}
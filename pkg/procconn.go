@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants from linux/connector.h and linux/cn_proc.h.
+const (
+	CN_IDX_PROC = 0x1
+	CN_VAL_PROC = 0x1
+
+	PROC_CN_MCAST_LISTEN = 1
+	PROC_CN_MCAST_IGNORE = 2
+
+	PROC_EVENT_FORK = 0x00000001
+	PROC_EVENT_EXEC = 0x00000002
+	PROC_EVENT_EXIT = 0x80000000
+
+	cnMsgLen        = 20
+	procEventHdrLen = 16
+)
+
+// ProcEvent is one notification from the kernel process connector. Exit events
+// carry the wait status of the task in ExitCode.
+type ProcEvent struct {
+	What       uint32
+	PID        int
+	TGID       int
+	ParentPID  int
+	ParentTGID int
+	ExitCode   uint32
+	ExitSignal uint32
+	Time       time.Time
+}
+
+// ProcConnector is a netlink socket subscribed to the kernel process connector.
+// It needs CAP_NET_ADMIN.
+type ProcConnector struct {
+	fd  int
+	buf []byte
+}
+
+func NewProcConnector() (*ProcConnector, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_CONNECTOR)
+	if err != nil {
+		return nil, err
+	}
+	addr := &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: CN_IDX_PROC, Pid: uint32(os.Getpid())}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	pc := &ProcConnector{fd: fd, buf: make([]byte, os.Getpagesize())}
+	if err := pc.setListen(PROC_CN_MCAST_LISTEN); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (pc *ProcConnector) setListen(op uint32) error {
+	msg := make([]byte, unix.NLMSG_HDRLEN+cnMsgLen+4)
+	binary.LittleEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.LittleEndian.PutUint16(msg[4:], unix.NLMSG_DONE)
+	binary.LittleEndian.PutUint32(msg[12:], uint32(os.Getpid()))
+	cn := msg[unix.NLMSG_HDRLEN:]
+	binary.LittleEndian.PutUint32(cn[0:], CN_IDX_PROC)
+	binary.LittleEndian.PutUint32(cn[4:], CN_VAL_PROC)
+	binary.LittleEndian.PutUint16(cn[16:], 4)
+	binary.LittleEndian.PutUint32(cn[cnMsgLen:], op)
+	return unix.Sendto(pc.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+}
+
+// Receive blocks until the kernel delivers the next batch of process events.
+func (pc *ProcConnector) Receive() ([]ProcEvent, error) {
+	n, _, err := unix.Recvfrom(pc.fd, pc.buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(pc.buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	var events []ProcEvent
+	for _, m := range msgs {
+		if len(m.Data) < cnMsgLen+procEventHdrLen {
+			continue
+		}
+		ev, ok := parseProcEvent(m.Data[cnMsgLen:])
+		if ok {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func parseProcEvent(data []byte) (ProcEvent, bool) {
+	ev := ProcEvent{
+		What: binary.LittleEndian.Uint32(data[0:]),
+		Time: time.Now(),
+	}
+	body := data[procEventHdrLen:]
+	u32 := func(i int) uint32 { return binary.LittleEndian.Uint32(body[i*4:]) }
+	switch ev.What {
+	case PROC_EVENT_FORK:
+		if len(body) < 16 {
+			return ev, false
+		}
+		ev.ParentPID, ev.ParentTGID = int(u32(0)), int(u32(1))
+		ev.PID, ev.TGID = int(u32(2)), int(u32(3))
+	case PROC_EVENT_EXEC:
+		if len(body) < 8 {
+			return ev, false
+		}
+		ev.PID, ev.TGID = int(u32(0)), int(u32(1))
+	case PROC_EVENT_EXIT:
+		if len(body) < 16 {
+			return ev, false
+		}
+		ev.PID, ev.TGID = int(u32(0)), int(u32(1))
+		ev.ExitCode, ev.ExitSignal = u32(2), u32(3)
+	default:
+		return ev, false
+	}
+	return ev, true
+}
+
+func (pc *ProcConnector) Close() error {
+	pc.setListen(PROC_CN_MCAST_IGNORE)
+	return unix.Close(pc.fd)
+}
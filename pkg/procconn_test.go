@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// procEventData lays out a proc_event: what, cpu, timestamp and the body
+// fields as 32 bit words.
+func procEventData(what uint32, fields ...uint32) []byte {
+	data := make([]byte, procEventHdrLen+4*len(fields))
+	binary.LittleEndian.PutUint32(data[0:], what)
+	for idx, field := range fields {
+		binary.LittleEndian.PutUint32(data[procEventHdrLen+4*idx:], field)
+	}
+	return data
+}
+
+func TestParseProcEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+		want ProcEvent
+	}{
+		{
+			name: "fork",
+			data: procEventData(PROC_EVENT_FORK, 10, 10, 11, 11),
+			ok:   true,
+			want: ProcEvent{What: PROC_EVENT_FORK, ParentPID: 10, ParentTGID: 10, PID: 11, TGID: 11},
+		},
+		{
+			name: "thread exec",
+			data: procEventData(PROC_EVENT_EXEC, 12, 11),
+			ok:   true,
+			want: ProcEvent{What: PROC_EVENT_EXEC, PID: 12, TGID: 11},
+		},
+		{
+			name: "exit by signal",
+			data: procEventData(PROC_EVENT_EXIT, 11, 11, 9, 17),
+			ok:   true,
+			want: ProcEvent{What: PROC_EVENT_EXIT, PID: 11, TGID: 11, ExitCode: 9, ExitSignal: 17},
+		},
+		{
+			// Since 4.18 exit events also carry the parent pid and tgid.
+			name: "exit with trailing fields",
+			data: procEventData(PROC_EVENT_EXIT, 11, 11, 256, 17, 10, 10),
+			ok:   true,
+			want: ProcEvent{What: PROC_EVENT_EXIT, PID: 11, TGID: 11, ExitCode: 256, ExitSignal: 17},
+		},
+		{name: "short fork", data: procEventData(PROC_EVENT_FORK, 10, 10, 11)},
+		{name: "short exec", data: procEventData(PROC_EVENT_EXEC, 12)},
+		{name: "short exit", data: procEventData(PROC_EVENT_EXIT, 11, 11, 0)},
+		{name: "uid change", data: procEventData(0x00000004, 11, 11, 0, 0)},
+	}
+	for _, test := range tests {
+		ev, ok := parseProcEvent(test.data)
+		if ok != test.ok {
+			t.Errorf("%s: ok %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		ev.Time = test.want.Time
+		if ev != test.want {
+			t.Errorf("%s: %+v, want %+v", test.name, ev, test.want)
+		}
+	}
+}
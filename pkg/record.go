@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	generationMu  sync.Mutex
+	generation    = 1
+	generationPID = -1
+)
+
+// SetGeneration sets the target incarnation that record files opened from now
+// on belong to.
+func SetGeneration(gen int, pid int) {
+	generationMu.Lock()
+	defer generationMu.Unlock()
+	generation = gen
+	generationPID = pid
+}
+
+func GetGeneration() (int, int) {
+	generationMu.Lock()
+	defer generationMu.Unlock()
+	return generation, generationPID
+}
+
+// OpenRecordFile creates filename, or appends to it when appendFile is set, and
+// starts a new segment with a "# generation=N pid=P ts=T" line so samples of
+// successive target incarnations can be split apart.
+func OpenRecordFile(filename string, appendFile bool) (*os.File, error) {
+	var f *os.File
+	var err error
+	if !appendFile {
+		f, err = os.Create(filename)
+	} else {
+		f, err = os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gen, pid := GetGeneration()
+	if _, err := fmt.Fprintf(f, "# generation=%d pid=%d ts=%d\n", gen, pid, time.Now().UnixNano()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants and sizes from linux/sock_diag.h and linux/inet_diag.h.
+const (
+	SOCK_DIAG_BY_FAMILY = 20
+
+	inetDiagReqLen    = 56
+	inetDiagMsgLen    = 72
+	inetDiagAllStates = 0xffffffff
+)
+
+// InetSocket is one TCP or UDP socket reported by sock_diag. Cookie is the
+// value bpf_get_socket_cookie returns for packets of the socket.
+type InetSocket struct {
+	Family   uint8
+	Protocol uint8
+	Src      net.IP
+	Dst      net.IP
+	Sport    uint16
+	Dport    uint16
+	Inode    uint64
+	Cookie   uint64
+}
+
+// SockDiag is a sock_diag netlink socket. It lists the sockets of the network
+// namespace it was created in.
+type SockDiag struct {
+	fd  int
+	buf []byte
+}
+
+func NewSockDiag() (*SockDiag, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &SockDiag{fd: fd, buf: make([]byte, 8*os.Getpagesize())}, nil
+}
+
+// Sockets dumps the sockets of family, AF_INET or AF_INET6, and protocol in
+// any state.
+func (sd *SockDiag) Sockets(family uint8, protocol uint8) ([]InetSocket, error) {
+	msg := make([]byte, unix.NLMSG_HDRLEN+inetDiagReqLen)
+	binary.LittleEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.LittleEndian.PutUint16(msg[4:], SOCK_DIAG_BY_FAMILY)
+	binary.LittleEndian.PutUint16(msg[6:], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	req := msg[unix.NLMSG_HDRLEN:]
+	req[0], req[1] = family, protocol
+	binary.LittleEndian.PutUint32(req[4:], inetDiagAllStates)
+	if err := unix.Sendto(sd.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var sockets []InetSocket
+	for {
+		n, _, err := unix.Recvfrom(sd.fd, sd.buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(sd.buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return sockets, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := -int32(binary.LittleEndian.Uint32(m.Data)); errno != 0 {
+						return nil, fmt.Errorf("sock_diag: %w", syscall.Errno(errno))
+					}
+				}
+				return sockets, nil
+			}
+			if len(m.Data) < inetDiagMsgLen {
+				continue
+			}
+			sockets = append(sockets, parseInetDiagMsg(m.Data, protocol))
+		}
+	}
+}
+
+// parseInetDiagMsg decodes an inet_diag_msg, whose ports are in network byte
+// order and cookie is split in two host order halves.
+func parseInetDiagMsg(data []byte, protocol uint8) InetSocket {
+	id := data[4:]
+	socket := InetSocket{
+		Family:   data[0],
+		Protocol: protocol,
+		Sport:    binary.BigEndian.Uint16(id[0:]),
+		Dport:    binary.BigEndian.Uint16(id[2:]),
+		Cookie:   uint64(binary.LittleEndian.Uint32(id[40:])) | uint64(binary.LittleEndian.Uint32(id[44:]))<<32,
+		Inode:    uint64(binary.LittleEndian.Uint32(data[68:])),
+	}
+	addrLen := net.IPv6len
+	if socket.Family == unix.AF_INET {
+		addrLen = net.IPv4len
+	}
+	socket.Src = append(net.IP(nil), id[4:4+addrLen]...)
+	socket.Dst = append(net.IP(nil), id[20:20+addrLen]...)
+	return socket
+}
+
+func (sd *SockDiag) Close() error {
+	return unix.Close(sd.fd)
+}
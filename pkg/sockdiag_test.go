@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// inetDiagMsg lays out an inet_diag_msg the way the kernel sends it.
+func inetDiagMsg(family uint8, src net.IP, dst net.IP, sport uint16, dport uint16, cookie uint64, inode uint32) []byte {
+	data := make([]byte, inetDiagMsgLen)
+	data[0] = family
+	id := data[4:]
+	binary.BigEndian.PutUint16(id[0:], sport)
+	binary.BigEndian.PutUint16(id[2:], dport)
+	if family == unix.AF_INET {
+		copy(id[4:], src.To4())
+		copy(id[20:], dst.To4())
+	} else {
+		copy(id[4:], src.To16())
+		copy(id[20:], dst.To16())
+	}
+	binary.LittleEndian.PutUint32(id[40:], uint32(cookie))
+	binary.LittleEndian.PutUint32(id[44:], uint32(cookie>>32))
+	binary.LittleEndian.PutUint32(data[68:], inode)
+	return data
+}
+
+func TestParseInetDiagMsg(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		protocol uint8
+		want     InetSocket
+	}{
+		{
+			name:     "ipv4 tcp",
+			data:     inetDiagMsg(unix.AF_INET, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 40000, 443, 0x1122334455667788, 123456),
+			protocol: unix.IPPROTO_TCP,
+			want: InetSocket{Family: unix.AF_INET, Protocol: unix.IPPROTO_TCP, Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2"),
+				Sport: 40000, Dport: 443, Inode: 123456, Cookie: 0x1122334455667788},
+		},
+		{
+			name:     "ipv6 udp listener",
+			data:     inetDiagMsg(unix.AF_INET6, net.ParseIP("fd00::1"), net.IPv6unspecified, 53, 0, 42, 7),
+			protocol: unix.IPPROTO_UDP,
+			want: InetSocket{Family: unix.AF_INET6, Protocol: unix.IPPROTO_UDP, Src: net.ParseIP("fd00::1"), Dst: net.IPv6unspecified,
+				Sport: 53, Inode: 7, Cookie: 42},
+		},
+		{
+			name:     "ipv4 mapped peer of an ipv6 socket",
+			data:     inetDiagMsg(unix.AF_INET6, net.ParseIP("::ffff:10.0.0.1"), net.ParseIP("::ffff:10.0.0.2"), 8080, 51000, 1<<40, 99),
+			protocol: unix.IPPROTO_TCP,
+			want: InetSocket{Family: unix.AF_INET6, Protocol: unix.IPPROTO_TCP, Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2"),
+				Sport: 8080, Dport: 51000, Inode: 99, Cookie: 1 << 40},
+		},
+	}
+	for _, test := range tests {
+		got := parseInetDiagMsg(test.data, test.protocol)
+		if got.Family != test.want.Family || got.Protocol != test.want.Protocol ||
+			got.Sport != test.want.Sport || got.Dport != test.want.Dport ||
+			got.Inode != test.want.Inode || got.Cookie != test.want.Cookie {
+			t.Errorf("%s: %+v, want %+v", test.name, got, test.want)
+		}
+		if !got.Src.Equal(test.want.Src) || !got.Dst.Equal(test.want.Dst) {
+			t.Errorf("%s: addresses %s %s, want %s %s", test.name, got.Src, got.Dst, test.want.Src, test.want.Dst)
+		}
+		if test.want.Family == unix.AF_INET && len(got.Src) != net.IPv4len {
+			t.Errorf("%s: ipv4 source is %d bytes", test.name, len(got.Src))
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package pkg
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/procfs"
+)
+
+// SocketInodes returns the inodes of the sockets proc has open.
+func SocketInodes(proc *procfs.Proc) map[uint64]bool {
+	targets, _ := proc.FileDescriptorTargets()
+	inodes := make(map[uint64]bool)
+	for _, target := range targets {
+		if !strings.HasPrefix(target, "socket:[") {
+			continue
+		}
+		inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]"), 10, 64)
+		if err == nil {
+			inodes[inode] = true
+		}
+	}
+	return inodes
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	jww "github.com/spf13/jwalterweatherman"
-	"os"
 	"os/exec"
 	"strings"
 	"unsafe"
@@ -69,18 +68,9 @@ func Htons(i uint16) uint16 {
 }
 
 func CreateProcessAndPipeToFile(cmd *exec.Cmd, filename string, appendFile bool) {
-	var logFile *os.File
-	var err error
-	if !appendFile {
-		logFile, err = os.Create(filename)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		logFile, _ = os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			panic(err)
-		}
+	logFile, err := OpenRecordFile(filename, appendFile)
+	if err != nil {
+		panic(err)
 	}
 
 	defer logFile.Close()
@@ -0,0 +1,134 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	procfs "github.com/prometheus/procfs"
+)
+
+// TargetSpec describes the process to monitor: a pid, a container (optionally
+// narrowed by Name), or a command line substring.
+//
+// PID is taken as a pid inside another pid namespace when PIDNamespace names a
+// /proc/<pid>/ns/pid file or when ContainerID is set as well.
+type TargetSpec struct {
+	Name         string
+	PID          int
+	ContainerID  string
+	PIDNamespace string
+	ProcRoot     string
+}
+
+func (spec TargetSpec) procRoot() string {
+	if spec.ProcRoot == "" {
+		return procfs.DefaultMountPoint
+	}
+	return spec.ProcRoot
+}
+
+func (spec TargetSpec) namespacedPID() bool {
+	return spec.PID != -1 && (spec.PIDNamespace != "" || spec.ContainerID != "")
+}
+
+// pidNamespacePath resolves the pid namespace PID lives in.
+func (spec TargetSpec) pidNamespacePath() (string, error) {
+	if spec.PIDNamespace != "" {
+		return spec.PIDNamespace, nil
+	}
+	proc, err := GetContainerProc(spec.procRoot(), spec.ContainerID, "")
+	if err != nil {
+		return "", err
+	}
+	return PidNSPath(spec.procRoot(), proc.PID), nil
+}
+
+// withPIDNamespace returns spec with PIDNamespace resolved for a pid inside a
+// container, so that Matches does not look the container up on every call.
+func (spec TargetSpec) withPIDNamespace() (TargetSpec, error) {
+	if !spec.namespacedPID() || spec.PIDNamespace != "" {
+		return spec, nil
+	}
+	nsPath, err := spec.pidNamespacePath()
+	if err != nil {
+		return spec, err
+	}
+	spec.PIDNamespace = nsPath
+	return spec, nil
+}
+
+// Find looks the target up among the running processes. Processes that exited
+// and wait to be reaped are not running.
+func (spec TargetSpec) Find() (procfs.Proc, error) {
+	proc, err := spec.find()
+	if err != nil {
+		return procfs.Proc{}, err
+	}
+	if !procAlive(proc) {
+		return procfs.Proc{}, fmt.Errorf("process %d has exited", proc.PID)
+	}
+	return proc, nil
+}
+
+func (spec TargetSpec) find() (procfs.Proc, error) {
+	if spec.namespacedPID() {
+		nsPath, err := spec.pidNamespacePath()
+		if err != nil {
+			return procfs.Proc{}, err
+		}
+		return TranslateNSPid(spec.procRoot(), nsPath, spec.PID)
+	}
+	if spec.ContainerID != "" {
+		return GetContainerProc(spec.procRoot(), spec.ContainerID, spec.Name)
+	}
+	fs, err := procfs.NewFS(spec.procRoot())
+	if err != nil {
+		return procfs.Proc{}, err
+	}
+	if spec.PID != -1 {
+		return fs.Proc(spec.PID)
+	}
+	procs, err := fs.AllProcs()
+	if err != nil {
+		return procfs.Proc{}, err
+	}
+	for _, p := range procs {
+		if spec.Matches(p) {
+			return p, nil
+		}
+	}
+	return procfs.Proc{}, fmt.Errorf("no process matching %s", spec.Name)
+}
+
+// Matches reports whether proc could be the target by only looking at proc
+// itself. Container targets still need Find to pick the main process. A pid
+// inside a container whose namespace is not resolved yet matches every
+// process of the container.
+func (spec TargetSpec) Matches(proc procfs.Proc) bool {
+	if !procAlive(proc) {
+		return false
+	}
+	if spec.namespacedPID() && spec.PIDNamespace != "" {
+		return procHasNSPid(spec.procRoot(), proc, spec.PIDNamespace, spec.PID)
+	}
+	if spec.ContainerID != "" {
+		if !procInContainer(proc, strings.ToLower(spec.ContainerID)) {
+			return false
+		}
+		return spec.Name == "" || cmdLineContains(proc, spec.Name)
+	}
+	if spec.PID != -1 {
+		return proc.PID == spec.PID
+	}
+	return cmdLineContains(proc, spec.Name) && !cmdLineContains(proc, "ogomon")
+}
+
+func cmdLineContains(proc procfs.Proc, s string) bool {
+	cmdParts, _ := proc.CmdLine()
+	for _, cmdPart := range cmdParts {
+		if strings.Contains(cmdPart, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	procfs "github.com/prometheus/procfs"
+	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	WAIT_POLL_INTERVAL = 200 * time.Millisecond
+)
+
+var ErrWaitCancelled = errors.New("stopped waiting for target")
+
+// WaitForTarget blocks until a process matching spec is running, until timeout
+// expires when it is not zero, or until cancel is closed. New processes are
+// noticed through proc connector exec events, /proc is polled at
+// WAIT_POLL_INTERVAL when the connector is unavailable.
+func WaitForTarget(spec TargetSpec, timeout time.Duration, cancel <-chan struct{}) (procfs.Proc, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	pc, err := NewProcConnector()
+	if err != nil {
+		jww.WARN.Println("proc connector unavailable, polling /proc: ", err)
+		return waitForTargetPolling(spec, deadline, cancel)
+	}
+	defer pc.Close()
+
+	// Subscribed before the first scan, so a process started in between is not missed.
+	if proc, err := spec.Find(); err == nil {
+		return proc, nil
+	}
+	// Resolved once, the container may not be running yet.
+	if resolved, err := spec.withPIDNamespace(); err == nil {
+		spec = resolved
+	}
+	fs, err := procfs.NewFS(spec.procRoot())
+	if err != nil {
+		return procfs.Proc{}, err
+	}
+	for {
+		select {
+		case <-cancel:
+			return procfs.Proc{}, ErrWaitCancelled
+		default:
+		}
+		// Bounded so that cancel is seen without an event.
+		pollTimeout := WAIT_POLL_INTERVAL
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return procfs.Proc{}, fmt.Errorf("timed out waiting for target")
+			}
+			if remaining < pollTimeout {
+				pollTimeout = remaining
+			}
+		}
+		fds := []unix.PollFd{{Fd: int32(pc.fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(pollTimeout/time.Millisecond))
+		if errors.Is(err, unix.EINTR) || n == 0 {
+			continue
+		}
+		if err != nil {
+			return procfs.Proc{}, err
+		}
+		events, err := pc.Receive()
+		if errors.Is(err, unix.ENOBUFS) {
+			// Events were dropped, the target may be among them.
+			if proc, err := spec.Find(); err == nil {
+				return proc, nil
+			}
+			continue
+		}
+		if err != nil {
+			return procfs.Proc{}, err
+		}
+		for _, ev := range events {
+			if ev.What != PROC_EVENT_EXEC {
+				continue
+			}
+			proc, err := fs.Proc(ev.TGID)
+			if err != nil || !spec.Matches(proc) {
+				continue
+			}
+			if spec.namespacedPID() && spec.PIDNamespace == "" {
+				// The container started, its pid namespace is known from now on.
+				resolved, err := spec.withPIDNamespace()
+				if err != nil {
+					return spec.Find()
+				}
+				spec = resolved
+				if proc, err := spec.Find(); err == nil {
+					return proc, nil
+				}
+				continue
+			}
+			// Find picks the main process and rejects ambiguous container ids.
+			if spec.ContainerID != "" {
+				return spec.Find()
+			}
+			return proc, nil
+		}
+	}
+}
+
+func waitForTargetPolling(spec TargetSpec, deadline time.Time, cancel <-chan struct{}) (procfs.Proc, error) {
+	for {
+		proc, err := spec.Find()
+		if err == nil {
+			return proc, nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return procfs.Proc{}, fmt.Errorf("timed out waiting for target: %w", err)
+		}
+		select {
+		case <-cancel:
+			return procfs.Proc{}, ErrWaitCancelled
+		case <-time.After(WAIT_POLL_INTERVAL):
+		}
+	}
+}